@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gorm.io/gorm"
+)
+
+const (
+	MaxAttachmentSize = 16 * 1024 * 1024
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// File attached to a note.
+type Attachment struct {
+	Id     int
+	NoteId int
+	Name   string
+	Size   int64
+	Ctime  ETime
+	Data   []byte // only loaded by FetchAttachment
+}
+
+// Name and data of the attachments are encrypted, data is stored as blob instead of hex string, see createRevisionTable
+// for the type of ctime.
+func createAttachmentTable(tx *gorm.DB) error {
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_attachment (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			note_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			ctime TEXT NOT NULL
+		)
+	`).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE INDEX IF NOT EXISTS attachment_note_idx ON pocket_attachment (note_id)`).Error
+}
+
+// Fetch attachments of the note without data.
+func (s *SqliteStorage) FetchAttachments(noteId int) ([]Attachment, error) {
+	var atts []Attachment
+	err := s.db.Raw(`SELECT id, note_id, name, size, ctime FROM pocket_attachment WHERE note_id = ? ORDER BY id`, noteId).
+		Scan(&atts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_attachment, %v", err)
+	}
+	if atts == nil {
+		atts = []Attachment{}
+	}
+	for i, a := range atts {
+		if atts[i].Name, err = DecryptBound(a.Name, attachmentAD(a.NoteId, a.Id, "name")); err != nil {
+			return nil, fmt.Errorf("failed to decrypt attachment %v, %v", a.Id, err)
+		}
+	}
+	return atts, nil
+}
+
+// Fetch attachment with decrypted data.
+func (s *SqliteStorage) FetchAttachment(id int) (Attachment, error) {
+	var atts []Attachment
+	err := s.db.Raw(`SELECT id, note_id, name, size, data, ctime FROM pocket_attachment WHERE id = ?`, id).
+		Scan(&atts).Error
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to query pocket_attachment, %v", err)
+	}
+	if len(atts) < 1 {
+		return Attachment{}, ErrAttachmentNotFound
+	}
+	a := atts[0]
+	if a.Name, err = DecryptBound(a.Name, attachmentAD(a.NoteId, a.Id, "name")); err != nil {
+		return Attachment{}, fmt.Errorf("failed to decrypt attachment %v, %v", a.Id, err)
+	}
+	err = withKey(func(key []byte) (err error) {
+		a.Data, err = OpenBound(key, a.Data, attachmentAD(a.NoteId, a.Id, "data"))
+		return err
+	})
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to decrypt attachment %v, %v", a.Id, err)
+	}
+	return a, nil
+}
+
+func (s *SqliteStorage) AddAttachment(noteId int, name string, data []byte) (Attachment, error) {
+	if len(data) > MaxAttachmentSize {
+		return Attachment{}, fmt.Errorf("attachment is too large, max size: %v bytes", MaxAttachmentSize)
+	}
+	if _, err := s.FetchNote(noteId); err != nil {
+		return Attachment{}, err
+	}
+
+	a := Attachment{NoteId: noteId, Name: name, Size: int64(len(data)), Ctime: Now(), Data: data}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		a, err = insertAttachment(tx, a)
+		return err
+	})
+	if err != nil {
+		return Attachment{}, err
+	}
+	a.Data = nil
+	return a, nil
+}
+
+// Save the attachment and return it with the id assigned, see rowAD.
+func insertAttachment(tx *gorm.DB, a Attachment) (Attachment, error) {
+	err := tx.Exec(`INSERT INTO pocket_attachment (note_id, name, size, data, ctime) VALUES (?,'',?,x'',?)`,
+		a.NoteId, a.Size, a.Ctime).Error
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to save pocket_attachment, %v", err)
+	}
+	if err := tx.Raw(`SELECT last_insert_rowid()`).Scan(&a.Id).Error; err != nil {
+		return Attachment{}, fmt.Errorf("failed to find id of newly saved attachment, %v", err)
+	}
+
+	en, err := EncryptBound(a.Name, attachmentAD(a.NoteId, a.Id, "name"))
+	if err != nil {
+		return Attachment{}, err
+	}
+	var ed []byte
+	err = withKey(func(key []byte) (err error) {
+		ed, err = SealBound(key, a.Data, attachmentAD(a.NoteId, a.Id, "data"))
+		return err
+	})
+	if err != nil {
+		return Attachment{}, err
+	}
+	err = tx.Exec(`UPDATE pocket_attachment SET name = ?, data = ? WHERE id = ?`, en, ed, a.Id).Error
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to save pocket_attachment, %v", err)
+	}
+	return a, nil
+}
+
+// Attachment is bound to both the note and its own id, so it can't be moved to other notes or swapped.
+func attachmentAD(noteId int, id int, column string) string {
+	return rowAD("pocket_attachment", column, noteId, id)
+}
+
+func (s *SqliteStorage) DeleteAttachment(id int) error {
+	t := s.db.Exec(`DELETE FROM pocket_attachment WHERE id = ?`, id)
+	if t.Error != nil {
+		return fmt.Errorf("failed to delete pocket_attachment, %v", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return ErrAttachmentNotFound
+	}
+	return nil
+}
+
+func deleteAttachments(tx *gorm.DB, noteId int) error {
+	if err := tx.Exec(`DELETE FROM pocket_attachment WHERE note_id = ?`, noteId).Error; err != nil {
+		return fmt.Errorf("failed to delete pocket_attachment, %v", err)
+	}
+	return nil
+}
+
+// Bind all attachments to their rows, see bindCiphertext.
+func bindAttachments(tx *gorm.DB) error {
+	var ids []int
+	if err := tx.Raw(`SELECT id FROM pocket_attachment`).Scan(&ids).Error; err != nil {
+		return fmt.Errorf("failed to query pocket_attachment, %v", err)
+	}
+	// attachments can be large, re-encrypt them one by one
+	for _, id := range ids {
+		var atts []Attachment
+		if err := tx.Raw(`SELECT id, note_id, name, data FROM pocket_attachment WHERE id = ?`, id).Scan(&atts).Error; err != nil {
+			return fmt.Errorf("failed to query pocket_attachment, %v", err)
+		}
+		if len(atts) < 1 {
+			continue
+		}
+		a := atts[0]
+		name, err := rebind(a.Name, attachmentAD(a.NoteId, id, "name"))
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v, %v", id, err)
+		}
+		var data []byte
+		err = withKey(func(key []byte) error {
+			dec, err := Open(key, a.Data)
+			if err != nil {
+				return err
+			}
+			data, err = SealBound(key, dec, attachmentAD(a.NoteId, id, "data"))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v, %v", id, err)
+		}
+		err = tx.Exec(`UPDATE pocket_attachment SET name = ?, data = ? WHERE id = ?`, name, data, id).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_attachment, %v", err)
+		}
+	}
+	return nil
+}
+
+// Re-encrypt all attachments with the new key, see ReencryptVault.
+func reencryptAttachments(tx *gorm.DB, oldKey []byte, newKey []byte) error {
+	if ok, err := tableExists(tx, "pocket_attachment"); err != nil || !ok {
+		return err
+	}
+	var ids []int
+	if err := tx.Raw(`SELECT id FROM pocket_attachment`).Scan(&ids).Error; err != nil {
+		return fmt.Errorf("failed to query pocket_attachment, %v", err)
+	}
+	// attachments can be large, re-encrypt them one by one
+	for _, id := range ids {
+		var atts []Attachment
+		if err := tx.Raw(`SELECT id, name, data FROM pocket_attachment WHERE id = ?`, id).Scan(&atts).Error; err != nil {
+			return fmt.Errorf("failed to query pocket_attachment, %v", err)
+		}
+		if len(atts) < 1 {
+			continue
+		}
+		a := atts[0]
+		name, err := reencrypt(oldKey, newKey, a.Name)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v, %v", id, err)
+		}
+		data, err := Open(oldKey, a.Data)
+		if err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v, %v", id, err)
+		}
+		if data, err = Seal(newKey, data); err != nil {
+			return fmt.Errorf("failed to re-encrypt attachment %v, %v", id, err)
+		}
+		err = tx.Exec(`UPDATE pocket_attachment SET name = ?, data = ? WHERE id = ?`, name, data, id).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_attachment, %v", err)
+		}
+	}
+	return nil
+}
+
+// Read file to be attached, returns the base name and content of the file.
+func ReadAttachmentFile(path string) (string, []byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		return "", nil, fmt.Errorf("%v is a directory", path)
+	}
+	if fi.Size() > MaxAttachmentSize {
+		return "", nil, fmt.Errorf("%v is too large, max size: %v bytes", path, MaxAttachmentSize)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Base(path), data, nil
+}
+
+// Write attachment to the path with 0600 permission, if path is a directory, the attachment's name is used
+// as the file name. Existing file is never overwritten. Returns the path of the written file.
+func WriteAttachmentFile(a Attachment, path string) (string, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, filepath.Base(a.Name))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(a.Data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAttachmentFile(t *testing.T) {
+	dir := t.TempDir()
+	a := Attachment{Name: "../id_rsa", Data: []byte("private key")}
+
+	path, err := WriteAttachmentFile(a, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "id_rsa") {
+		t.Fatalf("unexpected path, %v", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected permission, %v", fi.Mode().Perm())
+	}
+	if _, err := WriteAttachmentFile(a, path); err == nil {
+		t.Fatal("existing file shouldn't be overwritten")
+	}
+
+	name, data, err := ReadAttachmentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "id_rsa" || string(data) != "private key" {
+		t.Fatalf("unexpected file, %v, %s", name, data)
+	}
+}
@@ -0,0 +1,1097 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cast"
+	"golang.org/x/term"
+)
+
+const (
+	EnvPassword = "POCKET_PASSWORD"
+
+	CliPageLimit = 20
+)
+
+type CliCommand struct {
+	Usage string
+	Run   func(st Storage, args []string) error
+}
+
+// Subcommands that run without the TUI app, e.g., 'pocket passwd'.
+var cliCommands = map[string]CliCommand{
+	"passwd":       {Usage: "change master password", Run: CliChangePassword},
+	"keyfile":      {Usage: "generate key file with 'new <file>', require it to unlock the vault with 'set <file>', or stop requiring it with 'rm'", Run: CliKeyFile},
+	"recovery":     {Usage: "generate new recovery codes, or reset the forgotten password with a recovery code using 'pocket recovery reset'", Run: CliRecovery},
+	"encrypt-meta": {Usage: "'on' to encrypt note name and description (tags and notebooks stay in plaintext), 'off' to store them in plaintext", Run: CliEncryptMeta},
+	"list":         {Usage: "list notes, e.g., 'pocket list -page 2 -tags aws,prod -json'", Run: CliListNotes},
+	"search":       {Usage: "search notes by name and description, e.g., 'pocket search \"aws OR gcp\"'", Run: CliSearchNotes},
+	"show":         {Usage: "show note, e.g., 'pocket show 12'", Run: CliShowNote},
+	"add":          {Usage: "add note, e.g., 'pocket add -name aws -desc prod -content - < secret.txt'", Run: CliAddNote},
+	"edit":         {Usage: "edit note, only the specified fields are updated, e.g., 'pocket edit 12 -desc staging'", Run: CliEditNote},
+	"rm":           {Usage: "move note to trash, e.g., 'pocket rm 12'", Run: CliRemoveNote},
+	"trash":        {Usage: "list notes in trash, use '-days N' to purge notes in trash for more than N days when unlocked in the UI", Run: CliListTrash},
+	"restore":      {Usage: "restore note from trash, e.g., 'pocket restore 12'", Run: CliRestoreNote},
+	"purge":        {Usage: "permanently delete note in trash, e.g., 'pocket purge 12' or 'pocket purge -all'", Run: CliPurgeNote},
+	"mv":           {Usage: "move note to another notebook, e.g., 'pocket mv 12 infra/prod', use '/' for the root notebook", Run: CliMoveNote},
+	"notebooks":    {Usage: "list notebooks", Run: CliListNotebooks},
+	"attach":       {Usage: "attach file to note, e.g., 'pocket attach 12 ~/.ssh/id_rsa'", Run: CliAttachFile},
+	"attachments":  {Usage: "list attachments of note, e.g., 'pocket attachments 12'", Run: CliListAttachments},
+	"export":       {Usage: "export attachment to path with 0600 permission, e.g., 'pocket export 3 ~/.ssh/'", Run: CliExportAttachment},
+	"detach":       {Usage: "delete attachment, e.g., 'pocket detach 3'", Run: CliDeleteAttachment},
+	"totp":         {Usage: "print current TOTP code of note, e.g., 'pocket totp 12'", Run: CliTOTP},
+	"gen":          {Usage: "generate random password, or diceware passphrase with '-words N', e.g., 'pocket gen -length 32 -symbols=false'", Run: CliGenerate},
+	"merge":        {Usage: "merge notes from another pocket database, e.g., 'pocket merge ~/backup/pocket.db'", Run: CliMergeDB},
+	"editor":       {Usage: "print the external editor, persist it with 'set <cmd>' (e.g., 'pocket editor set \"code --wait\"'), or remove it with 'rm'", Run: CliEditor},
+}
+
+// Run subcommand specified in args, returns false if args doesn't contain any subcommand.
+func RunCli(st Storage, args []string) (bool, error) {
+	if len(args) < 1 {
+		return false, nil
+	}
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		return true, fmt.Errorf("unknown command '%v'", args[0])
+	}
+	return true, cmd.Run(st, args[1:])
+}
+
+func PrintCliUsage() {
+	names := make([]string, 0, len(cliCommands))
+	for k := range cliCommands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	out := os.Stderr
+	fmt.Fprintf(out, "\nCommands:\n")
+	for _, n := range names {
+		fmt.Fprintf(out, "  %-14s %s\n", n, cliCommands[n].Usage)
+	}
+}
+
+// Parse flags that may appear before or after the positional args, e.g., 'show 12 -json' and 'show -json 12'.
+func parseCliArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	pos := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() < 1 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newCliFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("pocket "+name, flag.ContinueOnError)
+}
+
+// Prompt for password on terminal without echoing.
+//
+// /dev/tty is preferred, so that stdin can still be used to pipe content.
+func ReadPassword(prompt string) (string, error) {
+	in := os.Stdin
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		in = tty
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(int(in.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password, %v", err)
+	}
+	defer wipeBytes(b)
+	return string(b), nil
+}
+
+// Read password from -password-fd, $POCKET_PASSWORD, or prompt for it on terminal.
+func ReadUnlockPassword() (string, error) {
+	if _passwordFd != nil && *_passwordFd > -1 {
+		f := os.NewFile(uintptr(*_passwordFd), "password-fd")
+		if f == nil {
+			return "", fmt.Errorf("invalid password fd %v", *_passwordFd)
+		}
+		defer f.Close()
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read password from fd %v, %v", *_passwordFd, err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if v, ok := os.LookupEnv(EnvPassword); ok {
+		return v, nil
+	}
+	return ReadPassword("Password: ")
+}
+
+func CliChangePassword(st Storage, args []string) error {
+	oldPw, err := ReadPassword("Current password: ")
+	if err != nil {
+		return err
+	}
+	newPw, err := ReadPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := ValidatePassword(newPw); err != nil {
+		return err
+	}
+	confirmPw, err := ReadPassword("Confirm new password: ")
+	if err != nil {
+		return err
+	}
+	if newPw != confirmPw {
+		return errors.New("passwords do not match")
+	}
+	if err := st.ChangePassword(oldPw, newPw); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Password changed")
+	return nil
+}
+
+// Read password and unlock the existing vault.
+func CliUnlock(st Storage) error {
+	_, err := cliUnlock(st)
+	return err
+}
+
+func cliUnlock(st Storage) (string, error) {
+	exists, err := st.VaultExists()
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errors.New("vault is not initialized yet, launch pocket to create one")
+	}
+	pw, err := ReadUnlockPassword()
+	if err != nil {
+		return "", err
+	}
+	ok, err := st.CheckPassword(pw)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("password incorrect")
+	}
+	return pw, nil
+}
+
+func CliKeyFile(st Storage, args []string) error {
+	if len(args) == 2 && args[0] == "new" {
+		if err := NewKeyFile(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Key file %v created, keep a backup of it, the vault can't be unlocked without it once it's set\n", args[1])
+		return nil
+	}
+
+	var path string
+	switch {
+	case len(args) == 2 && args[0] == "set":
+		path = args[1]
+	case len(args) == 1 && args[0] == "rm":
+	default:
+		return errors.New("usage: pocket keyfile new|set <file>, or pocket keyfile rm")
+	}
+	exists, err := st.VaultExists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("vault is not initialized yet, launch pocket to create one")
+	}
+	pw, err := ReadUnlockPassword()
+	if err != nil {
+		return err
+	}
+	if err := st.ChangeKeyFile(pw, path); err != nil {
+		return err
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Key file removed, only the password is required to unlock the vault")
+	} else {
+		fmt.Fprintf(os.Stderr, "Key file set, unlock the vault with '-keyfile %v' from now on\n", path)
+	}
+	return nil
+}
+
+func CliEditor(st Storage, args []string) error {
+	var set bool
+	var editor string
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "set":
+		set, editor = true, args[1]
+	case len(args) == 1 && args[0] == "rm":
+		set = true
+	default:
+		return errors.New("usage: pocket editor [set <cmd>|rm]")
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	if set {
+		return st.SetEditor(editor)
+	}
+	persisted, err := st.Editor()
+	if err != nil {
+		return err
+	}
+	fmt.Println(ResolveEditor(persisted))
+	return nil
+}
+
+func CliRecovery(st Storage, args []string) error {
+	if len(args) == 1 && args[0] == "reset" {
+		return cliResetPassword(st)
+	}
+	if len(args) != 0 {
+		return errors.New("usage: pocket recovery [reset]")
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	codes, err := st.GenerateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	for _, c := range codes {
+		fmt.Println(c)
+	}
+	fmt.Fprintln(os.Stderr, "Old recovery codes no longer work, keep the new ones somewhere safe, each of them can be used once")
+	return nil
+}
+
+func cliResetPassword(st Storage) error {
+	code, err := ReadPassword("Recovery code: ")
+	if err != nil {
+		return err
+	}
+	newPw, err := ReadPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if err := ValidatePassword(newPw); err != nil {
+		return err
+	}
+	confirmPw, err := ReadPassword("Confirm new password: ")
+	if err != nil {
+		return err
+	}
+	if newPw != confirmPw {
+		return errors.New("passwords do not match")
+	}
+	left, err := st.RecoverPassword(code, newPw)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Password reset, %v recovery codes left\n", left)
+	return nil
+}
+
+func CliEncryptMeta(st Storage, args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return errors.New("usage: pocket encrypt-meta on|off")
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	if err := st.SetMetaEncryption(args[0] == "on"); err != nil {
+		return err
+	}
+	if args[0] == "on" {
+		fmt.Fprintln(os.Stderr, "Warning: only names and descriptions are encrypted, tags and notebook paths are still stored in plaintext")
+		baks, err := st.BackupFiles()
+		if err != nil {
+			return err
+		}
+		if len(baks) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: backup files still contain plaintext names and descriptions, delete them if they are no longer needed:\n  %v\n",
+				strings.Join(baks, "\n  "))
+		}
+	}
+	return nil
+}
+
+// Note printed in JSON format.
+type cliNote struct {
+	Id       int         `json:"id"`
+	Name     string      `json:"name"`
+	Desc     string      `json:"desc"`
+	Content  *string     `json:"content,omitempty"`
+	Fields   []NoteField `json:"fields,omitempty"`
+	Tags     []string    `json:"tags"`
+	Notebook string      `json:"notebook"`
+	Ctime    ETime       `json:"ctime"`
+	Utime    ETime       `json:"utime"`
+}
+
+func toCliNote(n Note, withContent bool) cliNote {
+	tags := n.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	cn := cliNote{Id: n.Id, Name: n.Name, Desc: n.Desc, Tags: tags, Notebook: n.Notebook, Ctime: n.Ctime, Utime: n.Utime}
+	if withContent {
+		cn.Content = &n.Content
+		cn.Fields = n.Fields
+	}
+	return cn
+}
+
+func printJson(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func CliListNotes(st Storage, args []string) error {
+	fs := newCliFlagSet("list")
+	page := fs.Int("page", 1, "page number (1-based)")
+	limit := fs.Int("limit", CliPageLimit, "page size")
+	tags := fs.String("tags", "", "only list notes having all the tags, separated by comma")
+	notebook := fs.String("notebook", "", "only list notes in the notebook and its descendants")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	if _, err := parseCliArgs(fs, args); err != nil {
+		return err
+	}
+	q := NoteQuery{Page: *page, Limit: *limit, Tags: ParseTags(*tags), Notebook: NormalizeNotebook(*notebook)}
+	return cliFetchNotes(st, q, *asJson)
+}
+
+func CliSearchNotes(st Storage, args []string) error {
+	fs := newCliFlagSet("search")
+	page := fs.Int("page", 1, "page number (1-based)")
+	limit := fs.Int("limit", CliPageLimit, "page size")
+	tags := fs.String("tags", "", "only search notes having all the tags, separated by comma")
+	notebook := fs.String("notebook", "", "only search notes in the notebook and its descendants")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) < 1 {
+		return errors.New("usage: pocket search [flags] <query>")
+	}
+	q := NoteQuery{Page: *page, Limit: *limit, Keyword: strings.Join(pos, " "), Tags: ParseTags(*tags), Notebook: NormalizeNotebook(*notebook)}
+	return cliFetchNotes(st, q, *asJson)
+}
+
+func cliFetchNotes(st Storage, q NoteQuery, asJson bool) error {
+	if q.Page < 1 || q.Limit < 1 {
+		return errors.New("page and limit must be greater than 0")
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	total, notes, err := st.FetchNotes(q)
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		cns := make([]cliNote, 0, len(notes))
+		for _, n := range notes {
+			cns = append(cns, toCliNote(n, false))
+		}
+		return printJson(struct {
+			Total int       `json:"total"`
+			Page  int       `json:"page"`
+			Notes []cliNote `json:"notes"`
+		}{Total: total, Page: q.Page, Notes: cns})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tDESCRIPTION\tNOTEBOOK\tTAGS\tUPDATED AT")
+	for _, n := range notes {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", n.Id, oneLine(n.Name), oneLine(n.Desc), NotebookSep+n.Notebook,
+			FormatTags(n.Tags), n.Utime.FormatClassic())
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Page %d, total %d\n", q.Page, total)
+	return nil
+}
+
+func oneLine(s string) string {
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+func parseNoteId(pos []string, usage string) (int, error) {
+	if len(pos) != 1 {
+		return 0, errors.New(usage)
+	}
+	id, err := cast.ToIntE(pos[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid note id '%v'", pos[0])
+	}
+	return id, nil
+}
+
+func CliShowNote(st Storage, args []string) error {
+	fs := newCliFlagSet("show")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	contentOnly := fs.Bool("content", false, "only print the content")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket show [flags] <id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	n, err := st.FetchNote(id)
+	if err != nil {
+		return err
+	}
+
+	if *contentOnly {
+		fmt.Println(n.Content)
+		return nil
+	}
+	if *asJson {
+		return printJson(toCliNote(n, true))
+	}
+	fmt.Printf("Id: %d\nName: %s\nDescription: %s\nNotebook: %s\nTags: %s\nCreate Time: %s\nUpdate Time: %s\n",
+		n.Id, n.Name, n.Desc, NotebookSep+n.Notebook, FormatTags(n.Tags), n.Ctime.FormatClassic(), n.Utime.FormatClassic())
+	for _, f := range n.Fields {
+		fmt.Printf("%s (%s): %s\n", f.Name, f.Type, f.Value)
+	}
+	fmt.Printf("\n%s\n", n.Content)
+	return nil
+}
+
+// Repeatable -field flag, e.g., '-field username=admin -field pin:password=1234'.
+type cliFields []NoteField
+
+func (c *cliFields) String() string {
+	return ""
+}
+
+// Parse 'name:type=value' or 'name=value', type of the latter is inferred from the name, e.g., 'url=...' is a url field.
+func (c *cliFields) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(k) == "" {
+		return fmt.Errorf("invalid field '%v', expected name=value", v)
+	}
+	f := NoteField{Name: strings.TrimSpace(k), Type: FieldText, Value: val}
+	if name, typ, ok := strings.Cut(f.Name, ":"); ok {
+		if !IsFieldType(typ) {
+			return fmt.Errorf("unknown field type '%v', supported types: %v", typ, strings.Join(FieldTypes, ", "))
+		}
+		f.Name, f.Type = name, typ
+	} else if IsFieldType(f.Name) {
+		f.Type = f.Name
+	}
+	f.Secret = IsSecretFieldType(f.Type)
+	*c = append(*c, f)
+	return nil
+}
+
+// Only one of -desc, -content and -field can be read from stdin.
+func checkCliStdin(desc string, content string, fields cliFields) error {
+	n := 0
+	for _, v := range append([]string{desc, content}, fields.values()...) {
+		if v == "-" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of -desc, -content and -field can be read from stdin")
+	}
+	return nil
+}
+
+func (c cliFields) values() []string {
+	v := make([]string, 0, len(c))
+	for _, f := range c {
+		v = append(v, f.Value)
+	}
+	return v
+}
+
+// Add the fields to note, existing fields with the same name are replaced, fields with empty value are removed.
+func mergeCliFields(n *Note, fields cliFields) {
+	for _, f := range fields {
+		i := 0
+		for i < len(n.Fields) && n.Fields[i].Name != f.Name {
+			i++
+		}
+		switch {
+		case i < len(n.Fields) && f.Value == "":
+			n.Fields = append(n.Fields[:i], n.Fields[i+1:]...)
+		case i < len(n.Fields):
+			n.Fields[i] = f
+		case f.Value != "":
+			n.Fields = append(n.Fields, f)
+		}
+	}
+}
+
+// Read value of the flag, '-' means reading from stdin.
+func readCliValue(v string) (string, error) {
+	if v != "-" {
+		return v, nil
+	}
+	b, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from stdin, %v", err)
+	}
+	// only one trailing line ending (e.g., added by echo) is removed, secrets may have leading or trailing spaces
+	s := string(b)
+	if strings.HasSuffix(s, "\r\n") {
+		return strings.TrimSuffix(s, "\r\n"), nil
+	}
+	return strings.TrimSuffix(s, "\n"), nil
+}
+
+func CliAddNote(st Storage, args []string) error {
+	fs := newCliFlagSet("add")
+	name := fs.String("name", "", "name of the note")
+	desc := fs.String("desc", "", "description of the note, '-' to read from stdin")
+	content := fs.String("content", "", "content of the note, '-' to read from stdin")
+	tags := fs.String("tags", "", "tags of the note, separated by comma")
+	notebook := fs.String("notebook", "", "notebook of the note, e.g., 'infra/prod'")
+	fields := cliFields{}
+	fs.Var(&fields, "field", "field of the note, can be repeated, e.g., 'username=admin', 'password=-' or 'pin:password=1234'")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	if _, err := parseCliArgs(fs, args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*name) == "" {
+		return errors.New("usage: pocket add -name <name> [flags]")
+	}
+	if err := checkCliStdin(*desc, *content, fields); err != nil {
+		return err
+	}
+
+	var err error
+	if *desc, err = readCliValue(*desc); err != nil {
+		return err
+	}
+	if *content, err = readCliValue(*content); err != nil {
+		return err
+	}
+	for i := range fields {
+		if fields[i].Value, err = readCliValue(fields[i].Value); err != nil {
+			return err
+		}
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+
+	ctime := Now()
+	n := Note{Name: *name, Desc: *desc, Content: *content, Tags: ParseTags(*tags), Notebook: *notebook, Ctime: ctime, Utime: ctime}
+	mergeCliFields(&n, fields)
+	n, err = st.CreateNote(n)
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(toCliNote(n, false))
+	}
+	fmt.Println(n.Id)
+	return nil
+}
+
+func CliEditNote(st Storage, args []string) error {
+	fs := newCliFlagSet("edit")
+	name := fs.String("name", "", "name of the note")
+	desc := fs.String("desc", "", "description of the note, '-' to read from stdin")
+	content := fs.String("content", "", "content of the note, '-' to read from stdin")
+	tags := fs.String("tags", "", "tags of the note, separated by comma, replacing the existing ones")
+	fields := cliFields{}
+	fs.Var(&fields, "field", "field of the note, can be repeated, replacing the existing one with the same name, empty value removes the field")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket edit <id> [flags]")
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if len(set) < 1 {
+		return errors.New("nothing to update, specify at least one of -name, -desc, -content, -tags and -field")
+	}
+	if err := checkCliStdin(*desc, *content, fields); err != nil {
+		return err
+	}
+	if *desc, err = readCliValue(*desc); err != nil {
+		return err
+	}
+	if *content, err = readCliValue(*content); err != nil {
+		return err
+	}
+	for i := range fields {
+		if fields[i].Value, err = readCliValue(fields[i].Value); err != nil {
+			return err
+		}
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+
+	n, err := st.FetchNote(id)
+	if err != nil {
+		return err
+	}
+	if set["name"] {
+		if strings.TrimSpace(*name) == "" {
+			return errors.New("name can't be empty")
+		}
+		n.Name = *name
+	}
+	if set["desc"] {
+		n.Desc = *desc
+	}
+	if set["content"] {
+		n.Content = *content
+	}
+	if set["tags"] {
+		n.Tags = ParseTags(*tags)
+	}
+	mergeCliFields(&n, fields)
+	n.Utime = Now()
+	return st.UpdateNote(n)
+}
+
+func CliRemoveNote(st Storage, args []string) error {
+	fs := newCliFlagSet("rm")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket rm <id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	n, err := st.FetchNote(id)
+	if err != nil {
+		return err
+	}
+	return st.DeleteNote(n)
+}
+
+func CliListTrash(st Storage, args []string) error {
+	fs := newCliFlagSet("trash")
+	days := fs.Int("days", -1, "number of days notes are kept in trash before they are purged, 0 to keep them forever")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	if _, err := parseCliArgs(fs, args); err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	if *days > -1 {
+		return st.SetTrashRetention(*days)
+	}
+
+	trashed, err := st.FetchTrash()
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		type cliTrashedNote struct {
+			cliNote
+			Dtime ETime `json:"dtime"`
+		}
+		cns := make([]cliTrashedNote, 0, len(trashed))
+		for _, n := range trashed {
+			cns = append(cns, cliTrashedNote{cliNote: toCliNote(n.Note, false), Dtime: n.Dtime})
+		}
+		return printJson(cns)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tDESCRIPTION\tDELETED AT")
+	for _, n := range trashed {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", n.Id, oneLine(n.Name), oneLine(n.Desc), n.Dtime.FormatClassic())
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if retention, err := st.TrashRetention(); err == nil && retention > 0 {
+		fmt.Fprintf(os.Stderr, "Notes are purged after %d days in trash when the vault is unlocked in the UI\n", retention)
+	}
+	return nil
+}
+
+func CliRestoreNote(st Storage, args []string) error {
+	fs := newCliFlagSet("restore")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket restore <id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	return st.RestoreNote(id)
+}
+
+func CliPurgeNote(st Storage, args []string) error {
+	fs := newCliFlagSet("purge")
+	all := fs.Bool("all", false, "purge all notes in trash")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	usage := "usage: pocket purge <id> or pocket purge -all"
+	if *all {
+		if len(pos) > 0 {
+			return errors.New(usage)
+		}
+		if err := CliUnlock(st); err != nil {
+			return err
+		}
+		n, err := st.PurgeTrash(0)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Purged %d notes\n", n)
+		return nil
+	}
+	id, err := parseNoteId(pos, usage)
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	return st.PurgeNote(id)
+}
+
+func CliAttachFile(st Storage, args []string) error {
+	fs := newCliFlagSet("attach")
+	name := fs.String("name", "", "name of the attachment, base name of the file by default")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	usage := "usage: pocket attach [flags] <id> <file>"
+	if len(pos) != 2 {
+		return errors.New(usage)
+	}
+	id, err := parseNoteId(pos[:1], usage)
+	if err != nil {
+		return err
+	}
+	fname, data, err := ReadAttachmentFile(pos[1])
+	if err != nil {
+		return err
+	}
+	if *name != "" {
+		fname = *name
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	a, err := st.AddAttachment(id, fname, data)
+	if err != nil {
+		return err
+	}
+	fmt.Println(a.Id)
+	return nil
+}
+
+func CliListAttachments(st Storage, args []string) error {
+	fs := newCliFlagSet("attachments")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket attachments [flags] <id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	atts, err := st.FetchAttachments(id)
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		type cliAttachment struct {
+			Id    int    `json:"id"`
+			Name  string `json:"name"`
+			Size  int64  `json:"size"`
+			Ctime ETime  `json:"ctime"`
+		}
+		cas := make([]cliAttachment, 0, len(atts))
+		for _, a := range atts {
+			cas = append(cas, cliAttachment{Id: a.Id, Name: a.Name, Size: a.Size, Ctime: a.Ctime})
+		}
+		return printJson(cas)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSIZE\tCREATED AT")
+	for _, a := range atts {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", a.Id, a.Name, a.Size, a.Ctime.FormatClassic())
+	}
+	return w.Flush()
+}
+
+func CliExportAttachment(st Storage, args []string) error {
+	fs := newCliFlagSet("export")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	usage := "usage: pocket export <attachment-id> <path>"
+	if len(pos) != 2 {
+		return errors.New(usage)
+	}
+	id, err := parseNoteId(pos[:1], usage)
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	a, err := st.FetchAttachment(id)
+	if err != nil {
+		return err
+	}
+	path, err := WriteAttachmentFile(a, pos[1])
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func CliDeleteAttachment(st Storage, args []string) error {
+	fs := newCliFlagSet("detach")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket detach <attachment-id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	return st.DeleteAttachment(id)
+}
+
+func CliMoveNote(st Storage, args []string) error {
+	fs := newCliFlagSet("mv")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	usage := "usage: pocket mv <id> <notebook>"
+	if len(pos) != 2 {
+		return errors.New(usage)
+	}
+	id, err := parseNoteId(pos[:1], usage)
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	return st.MoveNote(id, pos[1])
+}
+
+func CliTOTP(st Storage, args []string) error {
+	fs := newCliFlagSet("totp")
+	field := fs.String("field", "", "name of the totp field, the first totp field by default")
+	verbose := fs.Bool("v", false, "also print the remaining seconds")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseNoteId(pos, "usage: pocket totp [flags] <id>")
+	if err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	n, err := st.FetchNote(id)
+	if err != nil {
+		return err
+	}
+
+	var t TOTP
+	if *field != "" {
+		i := 0
+		for i < len(n.Fields) && n.Fields[i].Name != *field {
+			i++
+		}
+		if i == len(n.Fields) {
+			return fmt.Errorf("field '%v' not found", *field)
+		}
+		t, err = ParseTOTP(n.Fields[i].Value)
+	} else {
+		t, err = NoteTOTP(n)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if *verbose {
+		fmt.Printf("%s %ds\n", t.Code(now), int(t.Remaining(now).Seconds()+0.5))
+		return nil
+	}
+	fmt.Println(t.Code(now))
+	return nil
+}
+
+func CliGenerate(st Storage, args []string) error {
+	fs := newCliFlagSet("gen")
+	def := DefaultPasswordOptions()
+	length := fs.Int("length", def.Length, fmt.Sprintf("length of the password, at most %d", MaxPasswordLength))
+	lower := fs.Bool("lower", def.Lower, "include lowercase letters")
+	upper := fs.Bool("upper", def.Upper, "include uppercase letters")
+	digits := fs.Bool("digits", def.Digits, "include digits")
+	symbols := fs.Bool("symbols", def.Symbols, "include symbols")
+	noAmbiguous := fs.Bool("no-ambiguous", false, "exclude ambiguous characters, e.g., 'l', '1', 'O' and '0'")
+	words := fs.Int("words", 0, fmt.Sprintf("generate diceware passphrase with the number of words (at most %d) instead", MaxPassphraseWords))
+	sep := fs.String("sep", "-", "separator of words in passphrase")
+	if _, err := parseCliArgs(fs, args); err != nil {
+		return err
+	}
+
+	var v string
+	var err error
+	if *words > 0 {
+		v, err = GeneratePassphrase(PassphraseOptions{Words: *words, Separator: *sep})
+	} else {
+		v, err = GeneratePassword(PasswordOptions{Length: *length, Lower: *lower, Upper: *upper, Digits: *digits, Symbols: *symbols,
+			ExcludeAmbiguous: *noAmbiguous})
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(v)
+	return nil
+}
+
+func CliListNotebooks(st Storage, args []string) error {
+	fs := newCliFlagSet("notebooks")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	if _, err := parseCliArgs(fs, args); err != nil {
+		return err
+	}
+	if err := CliUnlock(st); err != nil {
+		return err
+	}
+	notebooks, err := st.ListNotebooks()
+	if err != nil {
+		return err
+	}
+	notebooks = ExpandNotebooks(notebooks)
+	if *asJson {
+		return printJson(notebooks)
+	}
+	for _, nb := range notebooks {
+		fmt.Println(NotebookSep + nb)
+	}
+	return nil
+}
+
+func CliMergeDB(st Storage, args []string) error {
+	fs := newCliFlagSet("merge")
+	samePw := fs.Bool("same-password", false, "unlock the other vault with the same password")
+	asJson := fs.Bool("json", false, "print in JSON format")
+	pos, err := parseCliArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: pocket merge [flags] <file>")
+	}
+	file := pos[0]
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Errorf("failed to open %v, %v", file, err)
+	}
+
+	pw, err := cliUnlock(st)
+	if err != nil {
+		return err
+	}
+	if !*samePw {
+		if pw, err = ReadPassword(fmt.Sprintf("Password of %v: ", file)); err != nil {
+			return err
+		}
+	}
+
+	res, err := st.MergeDB(file, pw)
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		toCliNotes := func(notes []Note) []cliNote {
+			cns := make([]cliNote, 0, len(notes))
+			for _, n := range notes {
+				cns = append(cns, toCliNote(n, false))
+			}
+			return cns
+		}
+		return printJson(struct {
+			Added       []cliNote `json:"added"`
+			Skipped     []cliNote `json:"skipped"`
+			Conflicts   []cliNote `json:"conflicts"`
+			Revisions   int       `json:"revisions"`
+			Attachments int       `json:"attachments"`
+		}{Added: toCliNotes(res.Added), Skipped: toCliNotes(res.Skipped), Conflicts: toCliNotes(res.Conflicts),
+			Revisions: res.Revisions, Attachments: res.Attachments})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT	ID	NAME	CREATE TIME")
+	for _, g := range []struct {
+		label string
+		notes []Note
+	}{{"added", res.Added}, {"skipped", res.Skipped}, {"conflict", res.Conflicts}} {
+		for _, n := range g.notes {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", g.label, n.Id, oneLine(n.Name), n.Ctime.FormatClassic())
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, res)
+	if len(res.Conflicts) > 0 {
+		fmt.Fprintln(os.Stderr, "Conflicting notes are not imported, ids of conflicting notes refer to the notes in the other vault")
+	}
+	return nil
+}
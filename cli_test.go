@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadCliValue(t *testing.T) {
+	for in, expected := range map[string]string{"  pw \n": "  pw ", "pw\r\n": "pw", "pw\n\n": "pw\n", "pw\r": "pw\r", "pw": "pw"} {
+		f, err := os.CreateTemp(t.TempDir(), "stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(in)
+		f.Seek(0, 0)
+		stdin := os.Stdin
+		os.Stdin = f
+		v, err := readCliValue("-")
+		os.Stdin = stdin
+		f.Close()
+		if err != nil || v != expected {
+			t.Fatalf("unexpected value of %q, %q, %v", in, v, err)
+		}
+	}
+	if v, _ := readCliValue(" pw "); v != " pw " {
+		t.Fatalf("unexpected value, %q", v)
+	}
+}
+
+func TestCliNotes(t *testing.T) {
+	st := NewMemStorage()
+	if _, err := st.CheckPassword("mypassword"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvPassword, "mypassword")
+
+	if ok, err := RunCli(st, []string{"add", "-name", "aws", "-desc", "prod", "-content", "secret"}); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := RunCli(st, []string{"edit", "1", "-desc", "staging"}); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	n, err := st.FetchNote(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Name != "aws" || n.Desc != "staging" || n.Content != "secret" {
+		t.Fatalf("unexpected note, %+v", n)
+	}
+
+	if _, err := RunCli(st, []string{"edit", "1", "-field", "password=pw", "-field", "pin:password=1234", "-field", "url=https://aws.amazon.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunCli(st, []string{"edit", "1", "-field", "pin="}); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = st.FetchNote(1)
+	if len(n.Fields) != 2 || n.Fields[0] != (NoteField{Name: "password", Type: FieldPassword, Value: "pw", Secret: true}) || n.Fields[1].Type != FieldURL {
+		t.Fatalf("unexpected fields, %+v", n.Fields)
+	}
+	if _, err := RunCli(st, []string{"edit", "1", "-field", "pin:unknown=1234"}); err == nil {
+		t.Fatal("should fail with unknown field type")
+	}
+	if _, err := RunCli(st, []string{"totp", "1"}); err != ErrNoTotp {
+		t.Fatalf("note shouldn't have totp, %v", err)
+	}
+	if _, err := RunCli(st, []string{"edit", "1", "-field", "totp=not base32!"}); err == nil {
+		t.Fatal("should fail with invalid totp secret")
+	}
+	if _, err := RunCli(st, []string{"edit", "1", "-field", "totp=GEZDGNBVGY3TQOJQ"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunCli(st, []string{"totp", "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RunCli(st, []string{"rm", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if trashed, err := st.FetchTrash(); err != nil || len(trashed) != 1 {
+		t.Fatalf("note should be in trash, %+v, %v", trashed, err)
+	}
+	for _, args := range [][]string{{"show", "1"}, {"edit", "1", "-desc", "prod"}, {"mv", "1", "/archive/"}} {
+		if _, err := RunCli(st, args); err != ErrNoteInTrash {
+			t.Fatalf("%v should fail for note in trash, %v", args[0], err)
+		}
+	}
+	if _, err := RunCli(st, []string{"purge", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.FetchNote(1); err != ErrNoteNotFound {
+		t.Fatalf("note should be removed, %v", err)
+	}
+
+	t.Setenv(EnvPassword, "incorrect")
+	if _, err := RunCli(st, []string{"list"}); err == nil {
+		t.Fatal("should fail with incorrect password")
+	}
+	if _, err := RunCli(st, []string{"unknown"}); err == nil {
+		t.Fatal("should fail with unknown command")
+	}
+}
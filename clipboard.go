@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClipTimeout = 30 * time.Second
+)
+
+var (
+	// clipboard is cleared after the timeout, 0 never clears it
+	_clipTimeout = DefaultClipTimeout
+
+	// interval of the countdown and the clock it's measured with, only changed in tests
+	_clipTick = time.Second
+	_clipNow  = time.Now
+
+	// backends of the clipboard, replaced in tests
+	clipboardWrite = writeClipboard
+	clipboardRead  = readClipboard
+
+	_clip = &clipState{}
+)
+
+// Value that is copied by pocket and not yet cleared.
+type clipState struct {
+	sync.Mutex
+	seq   int
+	value string
+}
+
+// Clipboard tool that can both copy and paste.
+type clipboardTool struct {
+	copy  []string
+	paste []string
+	clear []string // command to clear the clipboard, empty means copying empty string
+}
+
+// Find clipboard tool of the desktop environment, e.g., wl-copy on wayland or xclip on X11.
+func findClipboardTool() (clipboardTool, bool) {
+	candidates := []clipboardTool{}
+	switch {
+	case runtime.GOOS == "darwin":
+		candidates = append(candidates, clipboardTool{copy: []string{"pbcopy"}, paste: []string{"pbpaste"}})
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, clipboardTool{copy: []string{"wl-copy"}, paste: []string{"wl-paste", "--no-newline"},
+				clear: []string{"wl-copy", "--clear"}})
+		}
+		if os.Getenv("DISPLAY") != "" {
+			candidates = append(candidates, clipboardTool{copy: []string{"xclip", "-selection", "clipboard", "-in"},
+				paste: []string{"xclip", "-selection", "clipboard", "-out"}})
+		}
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c.copy[0]); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(c.paste[0]); err != nil {
+			continue
+		}
+		return c, true
+	}
+	return clipboardTool{}, false
+}
+
+// Write OSC 52 escape sequence to the terminal, it's supported by most terminal emulators (and tmux with set-clipboard on),
+// and it also works over ssh.
+//
+// The sequence is written in a single write, so it's not interleaved with the screen drawn by tview.
+func writeOSC52(s string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open terminal, %v", err)
+	}
+	defer tty.Close()
+	seq := []byte("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(s)) + "\a")
+	if _, err := tty.Write(seq); err != nil {
+		return fmt.Errorf("failed to write to terminal, %v", err)
+	}
+	return nil
+}
+
+// Copy text with the clipboard tool (e.g., xclip or wl-copy), OSC 52 is only used when there isn't one or it fails,
+// so that the value isn't sent through the terminal (and multiplexers or logs) unless it's necessary.
+func writeClipboard(s string) error {
+	tool, ok := findClipboardTool()
+	if !ok {
+		return writeOSC52(s)
+	}
+	args := tool.copy
+	if s == "" && len(tool.clear) > 0 {
+		args = tool.clear
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(s)
+	if err := cmd.Run(); err != nil {
+		Debugf("Failed to copy with %v, %v", args[0], err)
+		if oscErr := writeOSC52(s); oscErr != nil {
+			return fmt.Errorf("failed to copy to clipboard, %v, %v", err, oscErr)
+		}
+	}
+	return nil
+}
+
+// Read text in clipboard, returns false if it can't be read, OSC 52 doesn't support reading clipboard.
+func readClipboard() (string, bool) {
+	tool, ok := findClipboardTool()
+	if !ok {
+		return "", false
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(tool.paste[0], tool.paste[1:]...)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", false
+	}
+	return out.String(), true
+}
+
+// Copy text to the system clipboard.
+//
+// The clipboard is cleared after the timeout if it still holds the value, 0 timeout never clears it.
+// When the clipboard can't be read (e.g., only OSC 52 is available), it's cleared unless something else is copied by pocket.
+//
+// If onTick is not nil, it's called every tick (a second) with the remaining time, and with 0 once the countdown is over,
+// cleared tells whether the clipboard is cleared, the countdown stops silently when another value is copied.
+func CopyToClipboard(s string, timeout time.Duration, onTick func(remaining time.Duration, cleared bool)) error {
+	if err := clipboardWrite(s); err != nil {
+		return err
+	}
+
+	_clip.Lock()
+	_clip.seq += 1
+	seq := _clip.seq
+	_clip.value = s
+	_clip.Unlock()
+
+	if timeout <= 0 {
+		return nil
+	}
+	go func() {
+		deadline := _clipNow().Add(timeout)
+		ticker := time.NewTicker(_clipTick)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			remaining := deadline.Sub(_clipNow())
+			if remaining <= 0 {
+				break
+			}
+			if !isClipSeq(seq) {
+				return
+			}
+			if onTick != nil {
+				onTick(remaining, false)
+			}
+		}
+		if !isClipSeq(seq) {
+			return
+		}
+		cleared := ClearClipboard()
+		if onTick != nil {
+			onTick(0, cleared)
+		}
+	}()
+	return nil
+}
+
+func isClipSeq(seq int) bool {
+	_clip.Lock()
+	defer _clip.Unlock()
+	return _clip.seq == seq
+}
+
+// Clear the clipboard if it still holds the value copied by pocket, returns true if it's cleared.
+func ClearClipboard() bool {
+	_clip.Lock()
+	defer _clip.Unlock()
+	if _clip.value == "" {
+		return false
+	}
+	v := _clip.value
+	_clip.value = ""
+	_clip.seq += 1
+	if cur, ok := clipboardRead(); ok && cur != v {
+		return false
+	}
+	if err := clipboardWrite(""); err != nil {
+		Debugf("Failed to clear clipboard, %v", err)
+		return false
+	}
+	return true
+}
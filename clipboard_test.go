@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopyToClipboard(t *testing.T) {
+	var mu sync.Mutex
+	board := ""
+	clipboardWrite = func(s string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		board = s
+		return nil
+	}
+	clipboardRead = func() (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		return board, true
+	}
+	// each tick advances the clock by step, no matter how long it actually takes
+	var clock time.Time
+	step := time.Second
+	_clipTick = time.Millisecond
+	_clipNow = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(step)
+		return clock
+	}
+	t.Cleanup(func() {
+		clipboardWrite, clipboardRead, _clipTick, _clipNow = writeClipboard, readClipboard, time.Second, time.Now
+	})
+
+	copyAndWait := func(s string, replaced string) (ticks int, cleared bool) {
+		done := make(chan bool)
+		err := CopyToClipboard(s, 3*time.Second, func(remaining time.Duration, c bool) {
+			if remaining > 0 {
+				ticks++
+				if replaced != "" {
+					clipboardWrite(replaced)
+				}
+				return
+			}
+			done <- c
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cleared = <-done:
+		case <-time.After(time.Second):
+			t.Fatal("clipboard not cleared")
+		}
+		return ticks, cleared
+	}
+
+	if ticks, cleared := copyAndWait("secret", ""); ticks != 2 || !cleared || board != "" {
+		t.Fatalf("clipboard should be cleared, %v, %v, %q", ticks, cleared, board)
+	}
+	if _, cleared := copyAndWait("secret", "copied by others"); cleared || board != "copied by others" {
+		t.Fatalf("clipboard shouldn't be cleared, %v, %q", cleared, board)
+	}
+
+	// countdown follows the clock rather than the number of ticks
+	step = 2 * time.Second
+	if ticks, cleared := copyAndWait("secret", ""); ticks != 1 || !cleared || board != "" {
+		t.Fatalf("clipboard should be cleared by the deadline, %v, %v, %q", ticks, cleared, board)
+	}
+}
@@ -1,57 +1,513 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 const (
-	SchemaVersion = "v0.0.0"
+	SchemaVersion = "v0.8.0"
 	CKeyPwTest    = "PasswordTest"
+	CKeyKdfParams = "KdfParams" // only used by vaults without data key, replaced by CKeyPwSlot
+	CKeyPwSlot    = "KeySlot:password"
+	CKeyEncMeta   = "EncryptMeta"
 	PwTestLen     = 13
 )
 
-// Storage API Contract
 var (
-	StDeleteNote    func(note Note) error                                       = DeleteNote
-	StEditNote      func(note Note) error                                       = UpdateNote
-	StCreateNote    func(note Note) (Note, error)                               = CreateNote
-	StFetchNotes    func(page int, limit int, name string) (int, []Note, error) = FetchNotes
-	StCheckPassword func() (bool, error)                                        = CheckPassword
-	StInitSchema    func() error                                                = InitSchema
+	ErrNoteNotFound = errors.New("note not found")
 )
 
-var (
-	_initSchemaFlag = false
-)
+// Storage API Contract
+type Storage interface {
+	VaultExists() (bool, error)
+	// Check password and unlock the vault, for new vault, the password is used to initialize the vault in InitSchema.
+	CheckPassword(pw string) (bool, error)
+	ChangePassword(oldPw string, newPw string) error
+	// Require the key file together with the password to unlock the vault, empty path removes the key file.
+	ChangeKeyFile(pw string, path string) error
+	// Replace recovery codes of the unlocked vault, each code can be used once to reset the password.
+	GenerateRecoveryCodes() ([]string, error)
+	// Unlock the vault with recovery code and set the new password, returns the number of recovery codes left.
+	RecoverPassword(code string, newPw string) (int, error)
+	InitSchema() error
+	// Wipe the vault key and decrypted data kept in memory, CheckPassword is required to unlock the vault again.
+	LockVault()
+
+	FetchNotes(q NoteQuery) (int, []Note, error)
+	// Fetch the note, notes in trash are rejected with ErrNoteInTrash until they are restored.
+	FetchNote(id int) (Note, error)
+	CreateNote(note Note) (Note, error)
+	// Update the note, notebook of the note is not changed, use MoveNote instead.
+	//
+	// Previous version of the note is recorded as a revision.
+	UpdateNote(note Note) error
+	// Move the note to trash, notes in trash are not returned by FetchNotes.
+	DeleteNote(note Note) error
+
+	FetchTrash() ([]TrashedNote, error)
+	RestoreNote(id int) error
+	PurgeNote(id int) error
+	PurgeTrash(age time.Duration) (int, error)
+	TrashRetention() (int, error)
+	// Purge notes that have been in trash for longer than TrashRetention, it's only called by the UI once unlocked,
+	// so that it's never a side effect of commands.
+	PurgeExpiredTrash() (int, error)
+	SetTrashRetention(days int) error
+	// Editor command persisted in vault, see ResolveEditor.
+	Editor() (string, error)
+	SetEditor(editor string) error
+
+	FetchAttachments(noteId int) ([]Attachment, error)
+	FetchAttachment(id int) (Attachment, error)
+	AddAttachment(noteId int, name string, data []byte) (Attachment, error)
+	DeleteAttachment(id int) error
+
+	FetchRevisions(noteId int) ([]Revision, error)
+	RestoreRevision(noteId int, revId int) (Note, error)
+
+	ListNotebooks() ([]string, error)
+	MoveNote(id int, notebook string) error
+
+	// Enable or disable encryption of note name and desc, plaintext left in the database file is purged when enabled.
+	SetMetaEncryption(enabled bool) error
+	MetaEncrypted() bool
+	// Backup files written before schema migrations, they are never updated, see BackupDB.
+	BackupFiles() ([]string, error)
+	MergeDB(file string, pw string) (MergeResult, error)
+}
 
 type Note struct {
-	Id      int
-	Name    string
-	Desc    string
-	Content string
-	Ctime   ETime
-	Utime   ETime
+	Id       int
+	Name     string
+	Desc     string
+	Content  string
+	Ctime    ETime
+	Utime    ETime
+	Tags     []string    `gorm:"-"`
+	Notebook string      `gorm:"-"` // e.g., 'infra/prod/db', empty string is the root notebook
+	Fields   []NoteField `gorm:"-"`
+}
+
+// Parameters of FetchNotes.
+type NoteQuery struct {
+	Page     int // 1-based
+	Limit    int
+	Keyword  string   // matched against name and desc
+	Tags     []string // notes must have all the tags
+	Notebook string   // notes in the notebook or any of its descendants
+}
+
+// Storage backed by SQLite database file.
+type SqliteStorage struct {
+	db   *gorm.DB
+	file string
+
+	initSchemaFlag bool
+	initKeySlot    KeySlot
+	initKeyFile    []byte // hash of the key file used by the new vault, nil if it doesn't use one
+
+	// whether note name and desc are encrypted in current vault
+	encryptMeta bool
+	metaIndex   *MetaIndex
+}
+
+var _ Storage = (*SqliteStorage)(nil)
+
+func NewSqliteStorage(db *gorm.DB, file string) *SqliteStorage {
+	return &SqliteStorage{db: db, file: file, metaIndex: &MetaIndex{}}
+}
+
+// Unwrap the vault data key with the password and check whether it's correct.
+//
+// Vaults created by the old versions (data encrypted directly with the password derived key) are upgraded on the fly.
+func (s *SqliteStorage) CheckPassword(pw string) (bool, error) {
+	exists, err := vaultExists(s.db)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		dataKey, err := NewDataKey()
+		if err != nil {
+			return false, err
+		}
+		keyFile, err := ReadKeyFile(_keyFile)
+		if err != nil {
+			return false, err
+		}
+		slot, err := NewKeySlot(keyFileSecret(pw, keyFile), dataKey)
+		if err != nil {
+			return false, err
+		}
+		InitKey(dataKey)
+		s.initKeySlot = slot
+		s.initKeyFile = keyFile
+		s.initSchemaFlag = true
+		return true, nil
+	}
+
+	if err := CheckSchemaVersion(s.db); err != nil {
+		return false, err
+	}
+
+	key, hasSlot, err := FindVaultKey(s.db, pw, _keyFile)
+	if err != nil || key == nil {
+		return false, err
+	}
+	if !hasSlot {
+		return s.upgradeVaultKey(pw, key)
+	}
+	if err := s.unlockVault(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Find the key that decrypts the vault using the password (and the key file if the vault requires one), key is nil
+// if the password is incorrect.
+//
+// For vaults created by the old versions, the key is derived directly from the password and hasSlot is false.
+func FindVaultKey(db *gorm.DB, pw string, keyFilePath string) (key []byte, hasSlot bool, err error) {
+	keyFile, err := vaultKeyFile(db, keyFilePath)
+	if err != nil {
+		return nil, false, err
+	}
+	v, hasSlot, err := GetConfig(db, CKeyPwSlot)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if hasSlot {
+		slot, err := ParseKeySlot(v)
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to parse %v, database may be corrupted, %v", CKeyPwSlot, err)
+		}
+		dataKey, ok := slot.Unlock(keyFileSecret(pw, keyFile))
+		if !ok {
+			return nil, true, nil
+		}
+		ok, err = checkKey(db, dataKey)
+		if err != nil {
+			return nil, true, err
+		}
+		if !ok {
+			return nil, true, errors.New("data key doesn't match the vault, database may be corrupted")
+		}
+		return dataKey, true, nil
+	}
+
+	kdf, ok, err := GetConfig(db, CKeyKdfParams)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		params, err := ParseKdfParams(kdf)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse %v, database may be corrupted, %v", CKeyKdfParams, err)
+		}
+		key = params.DeriveKey(pw)
+	} else {
+		if key, err = LegacyKey(pw); err != nil {
+			return nil, false, nil
+		}
+	}
+	ok, err = checkKey(db, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return key, false, nil
+}
+
+// Verify the old password, and wrap the vault data key with key derived from the new password.
+//
+// Only the password key slot is rewritten, the notes are still encrypted with the same data key.
+func (s *SqliteStorage) ChangePassword(oldPw string, newPw string) error {
+	exists, err := vaultExists(s.db)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("vault is not initialized yet")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		key, err := verifyVaultKey(tx, oldPw)
+		if err != nil {
+			return err
+		}
+		defer wipeBytes(key)
+		keyFile, err := vaultKeyFile(tx, _keyFile)
+		if err != nil {
+			return err
+		}
+		slot, err := NewKeySlot(keyFileSecret(newPw, keyFile), key)
+		if err != nil {
+			return err
+		}
+		if err := SetConfig(tx, CKeyPwSlot, slot.String()); err != nil {
+			return fmt.Errorf("failed to change password, %v", err)
+		}
+		return nil
+	})
+}
+
+// Unwrap the vault data key to verify the password, unlike CheckPassword, the vault is not unlocked, migrated or
+// purged, the returned key should be wiped by the caller.
+func verifyVaultKey(db *gorm.DB, pw string) ([]byte, error) {
+	if err := CheckSchemaVersion(db); err != nil {
+		return nil, err
+	}
+	key, hasSlot, err := FindVaultKey(db, pw, _keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("password incorrect")
+	}
+	if !hasSlot {
+		wipeBytes(key)
+		return nil, errors.New("vault is created by an old version, unlock it once to upgrade it first")
+	}
+	return key, nil
+}
+
+func (s *SqliteStorage) VaultExists() (bool, error) {
+	return vaultExists(s.db)
 }
 
-func CheckPassword() (bool, error) {
+func vaultExists(db *gorm.DB) (bool, error) {
+	return tableExists(db, "pocket_config")
+}
+
+func tableExists(db *gorm.DB, table string) (bool, error) {
 	var n string
-	err := GetDB().Raw(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'pocket_config'`).Scan(&n).Error
+	err := db.Raw(`SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n).Error
 	if err != nil {
 		return false, fmt.Errorf("failed to query database, %v", err)
 	}
-	firstTime := n == ""
-	if firstTime {
-		_initSchemaFlag = true
-		return true, nil
+	return n != "", nil
+}
+
+func columnExists(db *gorm.DB, table string, column string) (bool, error) {
+	var n int
+	err := db.Raw(`SELECT count(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to query database, %v", err)
+	}
+	return n > 0, nil
+}
+
+// Upgrade vault that is encrypted directly with the password derived key (either the legacy zero-padding
+// key or the key derived using CKeyKdfParams) to a random data key wrapped by the password.
+func (s *SqliteStorage) upgradeVaultKey(pw string, oldKey []byte) (bool, error) {
+	Debugf("Upgrading vault to random data key wrapped by %v derived key", KdfArgon2id)
+	defer wipeBytes(oldKey)
+	dataKey, err := NewDataKey()
+	if err != nil {
+		return false, err
+	}
+	slot, err := NewKeySlot(pw, dataKey)
+	if err != nil {
+		return false, err
+	}
+	if s.file != "" {
+		v, err := LoadSchemaVersion(s.db)
+		if err != nil {
+			return false, err
+		}
+		// every value is rewritten, backup the database the same way as schema migrations do
+		bak, err := BackupDB(s.db, s.file, v+"-legacy-key")
+		if err != nil {
+			return false, err
+		}
+		Debugf("Backed up database to %v before upgrading vault key", bak)
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := ReencryptVault(tx, oldKey, dataKey); err != nil {
+			return err
+		}
+		if err := SetConfig(tx, CKeyPwSlot, slot.String()); err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM pocket_config WHERE config_key = ?`, CKeyKdfParams).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to upgrade vault, %v", err)
+	}
+	if err := s.unlockVault(dataKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Set the key and load vault level configuration after the password is verified.
+func (s *SqliteStorage) unlockVault(key []byte) error {
+	InitKey(key)
+	if err := MigrateSchema(s.db, s.file); err != nil {
+		return err
 	}
+	meta, err := isMetaEncrypted(s.db)
+	if err != nil {
+		return err
+	}
+	s.encryptMeta = meta
+	s.metaIndex.Reset()
+	if meta {
+		return s.buildMetaIndex()
+	}
+	return nil
+}
+
+func (s *SqliteStorage) LockVault() {
+	WipeKey()
+	s.metaIndex.Reset()
+	s.initSchemaFlag = false
+	s.initKeySlot = KeySlot{}
+	s.initKeyFile = nil
+}
+
+func isMetaEncrypted(db *gorm.DB) (bool, error) {
+	v, ok, err := GetConfig(db, CKeyEncMeta)
+	if err != nil {
+		return false, err
+	}
+	return ok && v == "Y", nil
+}
 
-	var val string
-	err = GetDB().Raw(`SELECT config_value FROM pocket_config WHERE config_key = ?`, CKeyPwTest).
-		Scan(&val).Error
+func (s *SqliteStorage) MetaEncrypted() bool {
+	return s.encryptMeta
+}
+
+func (s *SqliteStorage) buildMetaIndex() error {
+	var notes []Note
+	err := s.db.Table("pocket_note").Select("rowid id, name, desc").Where(notTrashedSql).Scan(&notes).Error
+	if err != nil {
+		return fmt.Errorf("failed to query notes, %v", err)
+	}
+	for i := range notes {
+		if notes[i], err = s.decryptNoteMeta(notes[i]); err != nil {
+			return err
+		}
+	}
+	s.metaIndex.Build(notes)
+	return nil
+}
+
+// Enable or disable encryption of note name and desc, all notes are converted in a single transaction.
+func (s *SqliteStorage) SetMetaEncryption(enabled bool) error {
+	if enabled == s.encryptMeta {
+		return nil
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var notes []Note
+		if err := tx.Raw(`SELECT rowid id, name, desc FROM pocket_note`).Scan(&notes).Error; err != nil {
+			return fmt.Errorf("failed to query notes, %v", err)
+		}
+		for _, n := range notes {
+			var err error
+			if enabled {
+				n.Name, n.Desc, err = encryptPair(n.Name, noteAD(n.Id, "name"), n.Desc, noteAD(n.Id, "desc"))
+			} else {
+				n.Name, n.Desc, err = decryptPair(DecryptBound, n.Name, noteAD(n.Id, "name"), n.Desc, noteAD(n.Id, "desc"))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to convert note %v, %v", n.Id, err)
+			}
+			err = tx.Exec(`UPDATE pocket_note SET name = ?, desc = ? WHERE rowid = ?`, n.Name, n.Desc, n.Id).Error
+			if err != nil {
+				return fmt.Errorf("failed to update pocket_note, %v", err)
+			}
+		}
+		v := "N"
+		if enabled {
+			v = "Y"
+		}
+		return SetConfig(tx, CKeyEncMeta, v)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.encryptMeta = enabled
+	s.metaIndex.Reset()
+	if enabled {
+		if err := purgeFreePages(s.db); err != nil {
+			return err
+		}
+		return s.buildMetaIndex()
+	}
+	return nil
+}
+
+// Remove values left in free pages, old FTS segments and WAL after they are overwritten, e.g., the plaintext name
+// and desc after they are encrypted.
+func purgeFreePages(db *gorm.DB) error {
+	if err := db.Exec(`INSERT INTO pocket_note(pocket_note) VALUES('optimize')`).Error; err != nil {
+		return fmt.Errorf("failed to optimize pocket_note, %v", err)
+	}
+	if err := db.Exec(`VACUUM`).Error; err != nil {
+		return fmt.Errorf("failed to vacuum database, %v", err)
+	}
+	if err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`).Error; err != nil {
+		return fmt.Errorf("failed to checkpoint WAL, %v", err)
+	}
+	return nil
+}
+
+// Associated data that binds ciphertext to its row and column, e.g., 'pocket_note:12:content', see SealBound.
+//
+// The id is only known once the row is inserted, so new rows are inserted with empty values first, and updated
+// with the ciphertext in the same transaction.
+func rowAD(table string, column string, ids ...int) string {
+	b := strings.Builder{}
+	b.WriteString(table)
+	for _, id := range ids {
+		b.WriteString(":" + strconv.Itoa(id))
+	}
+	b.WriteString(":" + column)
+	return b.String()
+}
+
+func noteAD(id int, column string) string {
+	return rowAD("pocket_note", column, id)
+}
+
+// Decrypt value bound to the associated data, e.g., DecryptBound.
+type decryptFunc func(s string, ad string) (string, error)
+
+// Encrypt a and b bound to adA and adB respectively.
+func encryptPair(a string, adA string, b string, adB string) (string, string, error) {
+	a, err := EncryptBound(a, adA)
+	if err != nil {
+		return "", "", err
+	}
+	b, err = EncryptBound(b, adB)
+	return a, b, err
+}
+
+func decryptPair(decrypt decryptFunc, a string, adA string, b string, adB string) (string, string, error) {
+	a, err := decrypt(a, adA)
+	if err != nil {
+		return "", "", err
+	}
+	b, err = decrypt(b, adB)
+	return a, b, err
+}
+
+// Check whether the key can decrypt the password check value.
+func checkKey(db *gorm.DB, key []byte) (bool, error) {
+	val, ok, err := GetConfig(db, CKeyPwTest)
 	if err != nil {
 		return false, fmt.Errorf("failed to query pocket_config, database may be corrupted, %v", err)
 	}
-	val, err = Decrypt(val)
+	if !ok {
+		return false, fmt.Errorf("missing %v in pocket_config, database may be corrupted", CKeyPwTest)
+	}
+	val, err = DecryptWith(key, val)
 	if err != nil {
 		Debugf("Check password failed, %v", err)
 		return false, nil
@@ -59,6 +515,142 @@ func CheckPassword() (bool, error) {
 	return isValidPwCheckVal(val), nil
 }
 
+// Re-encrypt everything in the vault (password check value, notes, fields, revisions and attachments) with the new key,
+// only used when upgrading the vault.
+//
+// Should be called within a transaction, so that nothing is changed if any of the value can't be re-encrypted.
+func ReencryptVault(tx *gorm.DB, oldKey []byte, newKey []byte) error {
+	val, _, err := GetConfig(tx, CKeyPwTest)
+	if err != nil {
+		return err
+	}
+	if val, err = reencrypt(oldKey, newKey, val); err != nil {
+		return fmt.Errorf("failed to re-encrypt %v, %v", CKeyPwTest, err)
+	}
+	if err := SetConfig(tx, CKeyPwTest, val); err != nil {
+		return err
+	}
+
+	meta, err := isMetaEncrypted(tx)
+	if err != nil {
+		return err
+	}
+
+	var notes []Note
+	if err := tx.Raw(`SELECT rowid id, name, desc, content FROM pocket_note`).Scan(&notes).Error; err != nil {
+		return fmt.Errorf("failed to query notes, %v", err)
+	}
+	for _, n := range notes {
+		if n.Content, err = reencrypt(oldKey, newKey, n.Content); err != nil {
+			return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+		}
+		if meta {
+			if n.Name, err = reencrypt(oldKey, newKey, n.Name); err != nil {
+				return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+			}
+			if n.Desc, err = reencrypt(oldKey, newKey, n.Desc); err != nil {
+				return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+			}
+		}
+		err = tx.Exec(`UPDATE pocket_note SET name = ?, desc = ?, content = ? WHERE rowid = ?`, n.Name, n.Desc, n.Content, n.Id).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_note, %v", err)
+		}
+	}
+	if err := reencryptRevisions(tx, oldKey, newKey); err != nil {
+		return err
+	}
+	if err := reencryptFields(tx, oldKey, newKey); err != nil {
+		return err
+	}
+	return reencryptAttachments(tx, oldKey, newKey)
+}
+
+// Re-encrypt values encrypted by the old versions (either without envelope header or not bound to their rows), so that
+// they are bound to their rows, see SealBound.
+//
+// Should be called within a transaction, it's the migration to BoundSchemaVersion.
+func bindCiphertext(tx *gorm.DB) error {
+	meta, err := isMetaEncrypted(tx)
+	if err != nil {
+		return err
+	}
+
+	var notes []Note
+	if err := tx.Raw(`SELECT rowid id, name, desc, content FROM pocket_note`).Scan(&notes).Error; err != nil {
+		return fmt.Errorf("failed to query notes, %v", err)
+	}
+	for _, n := range notes {
+		if n.Content, err = rebind(n.Content, noteAD(n.Id, "content")); err != nil {
+			return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+		}
+		if meta {
+			if n.Name, err = rebind(n.Name, noteAD(n.Id, "name")); err != nil {
+				return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+			}
+			if n.Desc, err = rebind(n.Desc, noteAD(n.Id, "desc")); err != nil {
+				return fmt.Errorf("failed to re-encrypt note %v, %v", n.Id, err)
+			}
+		}
+		err = tx.Exec(`UPDATE pocket_note SET name = ?, desc = ?, content = ? WHERE rowid = ?`, n.Name, n.Desc, n.Content, n.Id).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_note, %v", err)
+		}
+	}
+	if err := bindRevisions(tx); err != nil {
+		return err
+	}
+	if err := bindFields(tx); err != nil {
+		return err
+	}
+	return bindAttachments(tx)
+}
+
+// Decrypt value that is not bound, and encrypt it bound to ad.
+func rebind(s string, ad string) (string, error) {
+	dec, err := Decrypt(s)
+	if err != nil {
+		return "", err
+	}
+	return EncryptBound(dec, ad)
+}
+
+func reencrypt(oldKey []byte, newKey []byte, s string) (string, error) {
+	dec, err := DecryptWith(oldKey, s)
+	if err != nil {
+		return "", err
+	}
+	return EncryptWith(newKey, dec)
+}
+
+func GetConfig(db *gorm.DB, key string) (string, bool, error) {
+	var vals []string
+	err := db.Raw(`SELECT config_value FROM pocket_config WHERE config_key = ? ORDER BY id LIMIT 1`, key).
+		Scan(&vals).Error
+	if err != nil {
+		return "", false, fmt.Errorf("failed to query pocket_config, %v", err)
+	}
+	if len(vals) < 1 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func SetConfig(db *gorm.DB, key string, val string) error {
+	t := db.Exec(`UPDATE pocket_config SET config_value = ? WHERE config_key = ?`, val, key)
+	if t.Error != nil {
+		return fmt.Errorf("failed to update pocket_config, %v", t.Error)
+	}
+	if t.RowsAffected > 0 {
+		return nil
+	}
+	err := db.Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, key, val).Error
+	if err != nil {
+		return fmt.Errorf("failed to insert pocket_config, %v", err)
+	}
+	return nil
+}
+
 func isValidPwCheckVal(s string) bool {
 	if s == CKeyPwTest {
 		return true
@@ -75,12 +667,12 @@ func isValidPwCheckVal(s string) bool {
 	return true
 }
 
-func InitSchema() error {
-	if !_initSchemaFlag {
+func (s *SqliteStorage) InitSchema() error {
+	if !s.initSchemaFlag {
 		return nil
 	}
 
-	err := GetDB().Exec(`
+	err := s.db.Exec(`
 		CREATE TABLE IF NOT EXISTS pocket_config (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			config_key TEXT NOT NULL,
@@ -91,7 +683,7 @@ func InitSchema() error {
 		return fmt.Errorf("failed to initialize schema, %v", err)
 	}
 
-	err = GetDB().Exec(`
+	err = s.db.Exec(`
 		CREATE INDEX IF NOT EXISTS key_idx ON pocket_config (config_key)
 	`).Error
 	if err != nil {
@@ -103,12 +695,24 @@ func InitSchema() error {
 		return err
 	}
 
-	err = GetDB().Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, CKeyPwTest, val).Error
+	err = s.db.Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, CKeyPwTest, val).Error
 	if err != nil {
 		return fmt.Errorf("failed to init pocket_config record, %v", err)
 	}
 
-	err = GetDB().Exec(`
+	err = s.db.Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, CKeyPwSlot, s.initKeySlot.String()).Error
+	if err != nil {
+		return fmt.Errorf("failed to init pocket_config record, %v", err)
+	}
+
+	if s.initKeyFile != nil {
+		err = s.db.Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, CKeyKeyFile, keyFileCheck(s.initKeyFile)).Error
+		if err != nil {
+			return fmt.Errorf("failed to init pocket_config record, %v", err)
+		}
+	}
+
+	err = s.db.Exec(`
 		CREATE VIRTUAL TABLE IF NOT EXISTS pocket_note USING fts4 (
 			name TEXT NOT NULL,
 			desc TEXT NOT NULL,
@@ -121,15 +725,42 @@ func InitSchema() error {
 		return fmt.Errorf("failed to initialize schema, %v", err)
 	}
 
+	err = s.db.Exec(`INSERT INTO pocket_config (config_key, config_value) VALUES (?,?)`, CKeySchemaVersion, BaseSchemaVersion).Error
+	if err != nil {
+		return fmt.Errorf("failed to init pocket_config record, %v", err)
+	}
+
+	// new vault doesn't need backup
+	if err := MigrateSchema(s.db, ""); err != nil {
+		return err
+	}
+	s.initSchemaFlag = false
+	s.initKeySlot = KeySlot{}
+	s.initKeyFile = nil
 	return nil
 }
 
-func FetchNotes(page int, limit int, kw string) (int, []Note, error) {
-	t := GetDB().Table("pocket_note").
-		Select(`count(*)`)
-	if kw != "" {
-		t = t.Where("name MATCH ? OR desc MATCH ?", kw, kw)
+func (s *SqliteStorage) FetchNotes(q NoteQuery) (int, []Note, error) {
+	if s.encryptMeta {
+		return s.fetchNotesByIndex(q)
 	}
+
+	where := func(t *gorm.DB) *gorm.DB {
+		t = t.Where(notTrashedSql)
+		if q.Keyword != "" {
+			t = t.Where("(name MATCH ? OR desc MATCH ?)", q.Keyword, q.Keyword)
+		}
+		if len(q.Tags) > 0 {
+			t = t.Where(tagFilterSql, q.Tags, len(q.Tags))
+		}
+		if q.Notebook != "" {
+			t = t.Where(notebookFilterSql, notebookFilterArgs(q.Notebook)...)
+		}
+		return t
+	}
+
+	t := where(s.db.Table("pocket_note").
+		Select(`count(*)`))
 	var total int
 	if err := t.Scan(&total).Error; err != nil {
 		return 0, nil, fmt.Errorf("failed to query notes, %v", err)
@@ -138,15 +769,11 @@ func FetchNotes(page int, limit int, kw string) (int, []Note, error) {
 		return total, []Note{}, nil
 	}
 
-	t = GetDB().Table("pocket_note").
+	t = where(s.db.Table("pocket_note").
 		Select("rowid id, name, desc, content, ctime, utime").
 		Order("id DESC").
-		Limit(limit).
-		Offset((page - 1) * limit)
-
-	if kw != "" {
-		t = t.Where("name MATCH ? OR desc MATCH ?", kw, kw)
-	}
+		Limit(q.Limit).
+		Offset((q.Page - 1) * q.Limit))
 
 	var notes []Note
 	if err := t.Scan(&notes).Error; err != nil {
@@ -156,61 +783,242 @@ func FetchNotes(page int, limit int, kw string) (int, []Note, error) {
 		notes = make([]Note, 0)
 	}
 	// Debugf("fetched notes: %#v", notes)
+	var err error
+	for i := range notes {
+		if notes[i], err = s.DecryptNote(notes[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := s.loadNoteRelations(notes); err != nil {
+		return 0, nil, err
+	}
+	return total, notes, nil
+}
+
+// Fetch notes using the in-memory MetaIndex, FTS can't be used when name and desc are encrypted.
+func (s *SqliteStorage) fetchNotesByIndex(q NoteQuery) (int, []Note, error) {
+	if !s.metaIndex.Built() {
+		if err := s.buildMetaIndex(); err != nil {
+			return 0, nil, err
+		}
+	}
+	var filters []map[int]struct{}
+	if len(q.Tags) > 0 {
+		tagged, err := findNoteIdsByTags(s.db, q.Tags)
+		if err != nil {
+			return 0, nil, err
+		}
+		filters = append(filters, tagged)
+	}
+	if q.Notebook != "" {
+		inNotebook, err := findNoteIdsByNotebook(s.db, q.Notebook)
+		if err != nil {
+			return 0, nil, err
+		}
+		filters = append(filters, inNotebook)
+	}
+	var filter func(id int) bool
+	if len(filters) > 0 {
+		filter = func(id int) bool {
+			for _, f := range filters {
+				if _, ok := f[id]; !ok {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	total, ids := s.metaIndex.Match(q.Page, q.Limit, q.Keyword, filter)
+	if len(ids) < 1 {
+		return total, []Note{}, nil
+	}
+
+	var notes []Note
+	err := s.db.Table("pocket_note").
+		Select("rowid id, name, desc, content, ctime, utime").
+		Where("rowid IN ?", ids).
+		Order("id DESC").
+		Scan(&notes).Error
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query notes, %v", err)
+	}
+	if notes == nil {
+		notes = make([]Note, 0)
+	}
 	for i := range notes {
-		notes[i] = DecryptNote(notes[i])
+		if notes[i], err = s.DecryptNote(notes[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := s.loadNoteRelations(notes); err != nil {
+		return 0, nil, err
 	}
 	return total, notes, nil
 }
 
-func CreateNote(n Note) (Note, error) {
-	en := EncryptNote(n)
+func (s *SqliteStorage) FetchNote(id int) (Note, error) {
+	if trashed, err := isTrashed(s.db, id); err != nil {
+		return Note{}, err
+	} else if trashed {
+		return Note{}, ErrNoteInTrash
+	}
+	return s.fetchNote(id)
+}
+
+// Fetch the note whether it's in trash or not.
+func (s *SqliteStorage) fetchNote(id int) (Note, error) {
+	var notes []Note
+	err := s.db.Raw(`SELECT rowid id, name, desc, content, ctime, utime FROM pocket_note WHERE rowid = ?`, id).
+		Scan(&notes).Error
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to query note, %v", err)
+	}
+	if len(notes) < 1 {
+		return Note{}, ErrNoteNotFound
+	}
+	if notes[0], err = s.DecryptNote(notes[0]); err != nil {
+		return Note{}, err
+	}
+	if err := s.loadNoteRelations(notes); err != nil {
+		return Note{}, err
+	}
+	return notes[0], nil
+}
 
-	err := GetDB().Exec(`
+// Load tags, notebooks and fields of the notes.
+func (s *SqliteStorage) loadNoteRelations(notes []Note) error {
+	if err := loadNoteTags(s.db, notes); err != nil {
+		return err
+	}
+	if err := loadNoteNotebooks(s.db, notes); err != nil {
+		return err
+	}
+	return loadNoteFields(s.db, DecryptBound, notes)
+}
+
+func (s *SqliteStorage) CreateNote(n Note) (Note, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		n, err = s.createNote(tx, n)
+		return err
+	})
+	if err != nil {
+		return Note{}, err
+	}
+	if s.encryptMeta {
+		s.metaIndex.Put(n)
+	}
+	return n, nil
+}
+
+// Save the note and return it with the id assigned, see rowAD.
+func (s *SqliteStorage) createNote(db *gorm.DB, n Note) (Note, error) {
+	err := db.Exec(`
 	INSERT INTO pocket_note (name, desc, content, ctime, utime)
-	VALUES (?,?,?,?,?)
-	`, en.Name, en.Desc, en.Content, en.Ctime, en.Utime).Error
+	VALUES ('','','',?,?)
+	`, n.Ctime, n.Utime).Error
 
 	if err != nil {
 		return Note{}, fmt.Errorf("failed to save note, %v", err)
 	}
 
 	var id int
-	err = GetDB().Raw(`SELECT last_insert_rowid()`).Scan(&id).Error
+	err = db.Raw(`SELECT last_insert_rowid()`).Scan(&id).Error
 	if err != nil {
 		return Note{}, fmt.Errorf("failed to find id of newly saved note, %v", err)
 	}
 
 	n.Id = id
+	en, err := s.EncryptNote(n)
+	if err != nil {
+		return Note{}, err
+	}
+	err = db.Exec(`UPDATE pocket_note SET name = ?, desc = ?, content = ? WHERE rowid = ?`, en.Name, en.Desc, en.Content, id).Error
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to save note, %v", err)
+	}
+	if err := setNoteTags(db, n.Id, n.Tags); err != nil {
+		return Note{}, err
+	}
+	if err := setNoteFields(db, n.Id, n.Fields); err != nil {
+		return Note{}, err
+	}
+	n.Notebook = NormalizeNotebook(n.Notebook)
+	if err := setNoteNotebook(db, n.Id, n.Notebook); err != nil {
+		return Note{}, err
+	}
 	return n, nil
 }
 
-func EncryptNote(n Note) Note {
-	n.Content = Encrypt0(n.Content)
-	return n
+// Encrypt the note bound to its id, nothing should be saved if it fails, e.g., the vault is locked.
+func (s *SqliteStorage) EncryptNote(n Note) (Note, error) {
+	var err error
+	if n.Content, err = EncryptBound(n.Content, noteAD(n.Id, "content")); err != nil {
+		return Note{}, fmt.Errorf("failed to encrypt note %v, %w", n.Id, err)
+	}
+	if s.encryptMeta {
+		if n.Name, n.Desc, err = encryptPair(n.Name, noteAD(n.Id, "name"), n.Desc, noteAD(n.Id, "desc")); err != nil {
+			return Note{}, fmt.Errorf("failed to encrypt note %v, %w", n.Id, err)
+		}
+	}
+	return n, nil
 }
 
-func DecryptNote(n Note) Note {
-	n.Content = Decrypt0(n.Content)
-	return n
+// Decrypt the note, values that fail authentication (e.g., moved from other notes) are rejected with error.
+func (s *SqliteStorage) DecryptNote(n Note) (Note, error) {
+	var err error
+	if n.Content, err = DecryptBound(n.Content, noteAD(n.Id, "content")); err != nil {
+		return Note{}, fmt.Errorf("failed to decrypt note %v, %w", n.Id, err)
+	}
+	return s.decryptNoteMeta(n)
 }
 
-func UpdateNote(n Note) error {
-	n = EncryptNote(n)
-	err := GetDB().Exec(`
-	UPDATE pocket_note
-	SET name = ?, desc = ?, content = ?, utime = ?
-	WHERE rowid = ?
-	`, n.Name, n.Desc, n.Content, n.Utime, n.Id).Error
+func (s *SqliteStorage) decryptNoteMeta(n Note) (Note, error) {
+	if s.encryptMeta {
+		var err error
+		if n.Name, n.Desc, err = decryptPair(DecryptBound, n.Name, noteAD(n.Id, "name"), n.Desc, noteAD(n.Id, "desc")); err != nil {
+			return Note{}, fmt.Errorf("failed to decrypt note %v, %w", n.Id, err)
+		}
+	}
+	return n, nil
+}
+
+func (s *SqliteStorage) UpdateNote(n Note) error {
+	en, err := s.EncryptNote(n)
 	if err != nil {
-		return fmt.Errorf("failed to update pocket_note, %v", err)
+		return err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.saveRevision(tx, n); err != nil {
+			return err
+		}
+		err := tx.Exec(`
+		UPDATE pocket_note
+		SET name = ?, desc = ?, content = ?, utime = ?
+		WHERE rowid = ?
+		`, en.Name, en.Desc, en.Content, en.Utime, en.Id).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_note, %v", err)
+		}
+		if err := setNoteTags(tx, n.Id, n.Tags); err != nil {
+			return err
+		}
+		return setNoteFields(tx, n.Id, n.Fields)
+	})
+	if err != nil {
+		return err
+	}
+	if s.encryptMeta {
+		s.metaIndex.Put(n)
 	}
 	return nil
 }
 
-func DeleteNote(note Note) error {
-	err := GetDB().Exec(`DELETE FROM pocket_note WHERE rowid = ?`, note.Id).Error
+func (s *SqliteStorage) DeleteNote(note Note) error {
+	err := s.db.Exec(`INSERT OR IGNORE INTO pocket_note_trash (note_id, dtime) VALUES (?,?)`, note.Id, Now()).Error
 	if err != nil {
-		return fmt.Errorf("failed to delete pocket_note, %v", err)
+		return fmt.Errorf("failed to move note to trash, %v", err)
 	}
+	s.metaIndex.Remove(note.Id)
 	return nil
 }
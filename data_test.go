@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSqliteStorage(t *testing.T) *SqliteStorage {
+	_kdfMemory = 64
+	t.Cleanup(func() { _kdfMemory = DefaultKdfMemory })
+
+	file := filepath.Join(t.TempDir(), "pocket.db")
+	db, err := OpenDB(file, false, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSqliteStorage(db, file)
+}
+
+func TestSqliteStorage(t *testing.T) {
+	testStorage(t, newTestSqliteStorage(t))
+}
+
+func TestMetaEncryptionPurge(t *testing.T) {
+	st := newTestSqliteStorage(t)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	if _, err := st.CreateNote(Note{Name: "plaintext-name", Desc: "plaintext-desc", Content: "secret", Ctime: now, Utime: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetMetaEncryption(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{st.file, st.file + "-wal"} {
+		b, err := os.ReadFile(f)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "plaintext-name") || strings.Contains(string(b), "plaintext-desc") {
+			t.Fatalf("plaintext is left in %v", f)
+		}
+	}
+}
+
+func TestUpgradeVaultKey(t *testing.T) {
+	st := newTestSqliteStorage(t)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	// vault of the old versions, encrypted with key derived from the password directly
+	key, err := LegacyKey("mypassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwTest, _ := EncryptWith(key, "1234567890123")
+	content, _ := EncryptWith(key, "secret")
+	fields, _ := EncryptWith(key, `[{"Name":"password","Type":"password","Value":"pw"}]`)
+	for _, q := range []string{
+		`DELETE FROM pocket_config WHERE config_key IN ('KeySlot:password', 'SchemaVersion')`,
+		`UPDATE pocket_config SET config_value = '` + pwTest + `' WHERE config_key = 'PasswordTest'`,
+		`INSERT INTO pocket_note (name, desc, content, ctime, utime) VALUES ('aws', '', '` + content + `', '2024/01/02 15:04:05', '2024/01/02 15:04:05')`,
+		`INSERT INTO pocket_note_revision (note_id, name, desc, content, fields, utime, rtime) VALUES (1, '` + content + `', '` + content +
+			`', '` + content + `', '` + fields + `', '2024/01/02 15:04:05', '2024/01/02 15:04:05')`,
+	} {
+		if err := st.db.Exec(q).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.LockVault()
+
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n, err := st.FetchNote(1); err != nil || n.Content != "secret" {
+		t.Fatalf("failed to fetch upgraded note, %+v, %v", n, err)
+	}
+	revs, err := st.FetchRevisions(1)
+	if err != nil || len(revs) != 1 || len(revs[0].Fields) != 1 || revs[0].Fields[0].Value != "pw" {
+		t.Fatalf("failed to fetch upgraded revision, %+v, %v", revs, err)
+	}
+	if err := st.db.Raw(`SELECT fields FROM pocket_note_revision WHERE id = ?`, revs[0].Id).Scan(&fields).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptBound(fields, revisionAD(1, revs[0].Id, "fields")); err != nil {
+		t.Fatalf("fields of revision are not bound to the new key, %v", err)
+	}
+	baks, _ := filepath.Glob(st.file + "." + BaseSchemaVersion + "-legacy-key.*.bak")
+	if len(baks) != 1 {
+		t.Fatalf("database is not backed up before upgrading vault key, %v", baks)
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	testStorage(t, NewMemStorage())
+}
+
+// Storage contract shared by all the backends.
+func testStorage(t *testing.T, st Storage) {
+	if ok, err := st.VaultExists(); err != nil || ok {
+		t.Fatal("vault shouldn't exist", ok, err)
+	}
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.VaultExists(); err != nil || !ok {
+		t.Fatal("vault should exist", ok, err)
+	}
+
+	now := Now()
+	aws, err := st.CreateNote(Note{Name: "aws", Desc: "prod account", Content: "secret", Tags: []string{"cloud", "prod"}, Notebook: "/infra/prod/",
+		Fields: []NoteField{{Name: "url", Type: FieldURL, Value: "https://aws.amazon.com"}, {Name: "password", Type: FieldPassword, Value: "pw", Secret: true}},
+		Ctime:  now, Utime: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateNote(Note{Name: "gcp", Desc: "staging", Content: "secret2", Tags: []string{"cloud"}, Ctime: now, Utime: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, meta := range []bool{false, true} {
+		if err := st.SetMetaEncryption(meta); err != nil {
+			t.Fatal(err)
+		}
+		if st.MetaEncrypted() != meta {
+			t.Fatal("meta encryption not updated")
+		}
+
+		total, notes, err := st.FetchNotes(NoteQuery{Page: 1, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || len(notes) != 1 || notes[0].Name != "gcp" {
+			t.Fatalf("unexpected result, %v, %+v", total, notes)
+		}
+
+		total, notes, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Keyword: "prod"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(notes) != 1 || notes[0].Content != "secret" {
+			t.Fatalf("unexpected result, %v, %+v", total, notes)
+		}
+
+		total, notes, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Tags: []string{"cloud", "prod"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(notes) != 1 || notes[0].Name != "aws" || len(notes[0].Tags) != 2 {
+			t.Fatalf("unexpected result, %v, %+v", total, notes)
+		}
+
+		total, _, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Keyword: "prod", Tags: []string{"cloud"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 {
+			t.Fatalf("unexpected total, %v", total)
+		}
+
+		total, _, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Keyword: "staging", Tags: []string{"prod"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 {
+			t.Fatalf("unexpected total, %v", total)
+		}
+
+		total, notes, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Notebook: "infra"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(notes) != 1 || notes[0].Notebook != "infra/prod" {
+			t.Fatalf("unexpected result, %v, %+v", total, notes)
+		}
+
+		total, _, err = st.FetchNotes(NoteQuery{Page: 1, Limit: 5, Notebook: "infra/pro"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 {
+			t.Fatalf("unexpected total, %v", total)
+		}
+	}
+
+	if n, err := st.FetchNote(aws.Id); err != nil || len(n.Fields) != 2 || n.Fields[1] != aws.Fields[1] {
+		t.Fatalf("unexpected fields, %+v, %v", n, err)
+	}
+
+	aws.Content = "updated"
+	aws.Tags = []string{"cloud"}
+	aws.Fields = []NoteField{{Name: "password", Type: FieldPassword, Value: "pw2", Secret: true}}
+	if err := st.UpdateNote(aws); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.FetchNote(aws.Id); err != nil || n.Content != "updated" || len(n.Tags) != 1 || n.Notebook != "infra/prod" ||
+		len(n.Fields) != 1 || n.Fields[0].Value != "pw2" {
+		t.Fatalf("note not updated, %+v, %v", n, err)
+	}
+	invalid := aws
+	invalid.Fields = []NoteField{{Name: "pin", Type: "unknown"}}
+	if err := st.UpdateNote(invalid); err == nil {
+		t.Fatal("field type should be invalid")
+	}
+
+	revs, err := st.FetchRevisions(aws.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs[0].Content != "secret" || revs[0].Name != "aws" || revs[0].Rtime.ToTime().IsZero() {
+		t.Fatalf("unexpected revisions, %+v", revs)
+	}
+	if n, err := st.RestoreRevision(aws.Id, revs[0].Id); err != nil || n.Content != "secret" || len(n.Fields) != 2 {
+		t.Fatalf("failed to restore revision, %+v, %v", n, err)
+	}
+	if revs, err := st.FetchRevisions(aws.Id); err != nil || len(revs) != 2 || revs[0].Content != "updated" || revs[0].Fields[0].Value != "pw2" {
+		t.Fatalf("unexpected revisions, %+v, %v", revs, err)
+	}
+
+	// changing only the fields is recorded as well, so the old secret can be restored
+	aws, _ = st.FetchNote(aws.Id)
+	aws.Fields = []NoteField{aws.Fields[0], {Name: "password", Type: FieldPassword, Value: "pw3", Secret: true}}
+	if err := st.UpdateNote(aws); err != nil {
+		t.Fatal(err)
+	}
+	revs, err = st.FetchRevisions(aws.Id)
+	if err != nil || len(revs) != 3 || len(revs[0].Fields) != 2 || revs[0].Fields[1].Value != "pw" {
+		t.Fatalf("unexpected revisions, %+v, %v", revs, err)
+	}
+	if n, err := st.RestoreRevision(aws.Id, revs[0].Id); err != nil || n.Fields[1].Value != "pw" {
+		t.Fatalf("failed to restore revision, %+v, %v", n, err)
+	}
+	if n, err := st.FetchNote(aws.Id); err != nil || len(n.Fields) != 2 || n.Fields[1].Value != "pw" {
+		t.Fatalf("fields are not restored, %+v, %v", n, err)
+	}
+
+	if err := st.MoveNote(aws.Id, "infra/staging"); err != nil {
+		t.Fatal(err)
+	}
+	if notebooks, err := st.ListNotebooks(); err != nil || len(notebooks) != 1 || notebooks[0] != "infra/staging" {
+		t.Fatalf("unexpected notebooks, %v, %v", notebooks, err)
+	}
+
+	if err := st.ChangePassword("incorrect", "mypassword2"); err == nil {
+		t.Fatal("should fail to change password")
+	}
+	if err := st.ChangePassword("mypassword", "mypassword2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.CheckPassword("mypassword"); err != nil || ok {
+		t.Fatal("old password should be rejected", ok, err)
+	}
+	if ok, err := st.CheckPassword("mypassword2"); err != nil || !ok {
+		t.Fatal("new password should be accepted", ok, err)
+	}
+
+	st.LockVault()
+	if err := st.ChangePassword("mypassword2", "mypassword"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GenerateRecoveryCodes(); !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("changing password should not unlock the vault, %v", err)
+	}
+	if err := st.ChangePassword("mypassword", "mypassword2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.CheckPassword("mypassword2"); err != nil || !ok {
+		t.Fatal("vault should be unlocked", ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.FetchNote(aws.Id); err != nil || n.Content != "secret" || len(n.Fields) != 2 {
+		t.Fatalf("unexpected note after unlocking, %+v, %v", n, err)
+	}
+
+	codes, err := st.GenerateRecoveryCodes()
+	if err != nil || len(codes) != RecoveryCodeCount {
+		t.Fatalf("unexpected recovery codes, %v, %v", codes, err)
+	}
+	st.LockVault()
+	if _, err := st.RecoverPassword("incorrect", "mypassword3"); err != ErrRecoveryCodeWrong {
+		t.Fatalf("recovery code should be rejected, %v", err)
+	}
+	if left, err := st.RecoverPassword(strings.ToLower(codes[1]), "mypassword3"); err != nil || left != RecoveryCodeCount-1 {
+		t.Fatalf("failed to recover password, %v, %v", left, err)
+	}
+	if _, err := st.RecoverPassword(codes[1], "mypassword4"); err != ErrRecoveryCodeWrong {
+		t.Fatalf("recovery code should only be used once, %v", err)
+	}
+	if ok, err := st.CheckPassword("mypassword3"); err != nil || !ok {
+		t.Fatal("password should be reset", ok, err)
+	}
+	if n, err := st.FetchNote(aws.Id); err != nil || n.Content != "secret" {
+		t.Fatalf("unexpected note after recovery, %+v, %v", n, err)
+	}
+
+	att, err := st.AddAttachment(aws.Id, "id_rsa", []byte("private key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atts, err := st.FetchAttachments(aws.Id); err != nil || len(atts) != 1 || atts[0].Name != "id_rsa" || atts[0].Data != nil ||
+		atts[0].Ctime.ToTime().IsZero() {
+		t.Fatalf("unexpected attachments, %+v, %v", atts, err)
+	}
+	if a, err := st.FetchAttachment(att.Id); err != nil || string(a.Data) != "private key" || a.Size != 11 {
+		t.Fatalf("unexpected attachment, %+v, %v", a, err)
+	}
+	if _, err := st.AddAttachment(aws.Id, "pdf", make([]byte, MaxAttachmentSize+1)); err == nil {
+		t.Fatal("attachment should be too large")
+	}
+	if _, err := st.AddAttachment(aws.Id, "cert", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteAttachment(att.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.FetchAttachment(att.Id); err != ErrAttachmentNotFound {
+		t.Fatalf("attachment should be deleted, %v", err)
+	}
+
+	if err := st.DeleteNote(aws); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, err := st.FetchNotes(NoteQuery{Page: 1, Limit: 5}); err != nil || total != 1 {
+		t.Fatalf("note in trash shouldn't be listed, %v, %v", total, err)
+	}
+	if trashed, err := st.FetchTrash(); err != nil || len(trashed) != 1 || trashed[0].Id != aws.Id || trashed[0].Dtime.ToTime().IsZero() {
+		t.Fatalf("note should be in trash, %+v, %v", trashed, err)
+	}
+	if _, err := st.FetchNote(aws.Id); err != ErrNoteInTrash {
+		t.Fatalf("note in trash shouldn't be fetched, %v", err)
+	}
+	if err := st.MoveNote(aws.Id, "/archive/"); err != ErrNoteInTrash {
+		t.Fatalf("note in trash shouldn't be moved, %v", err)
+	}
+	if err := st.RestoreNote(aws.Id); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, err := st.FetchNotes(NoteQuery{Page: 1, Limit: 5}); err != nil || total != 2 {
+		t.Fatalf("note should be restored, %v, %v", total, err)
+	}
+
+	if err := st.DeleteNote(aws); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.PurgeTrash(time.Hour); err != nil || n != 0 {
+		t.Fatalf("note shouldn't be purged yet, %v, %v", n, err)
+	}
+	if n, err := st.PurgeTrash(0); err != nil || n != 1 {
+		t.Fatalf("note should be purged, %v, %v", n, err)
+	}
+	if _, err := st.FetchNote(aws.Id); err != ErrNoteNotFound {
+		t.Fatalf("note should be deleted, %v", err)
+	}
+	if revs, err := st.FetchRevisions(aws.Id); err != nil || len(revs) != 0 {
+		t.Fatalf("revisions should be deleted, %+v, %v", revs, err)
+	}
+	if atts, err := st.FetchAttachments(aws.Id); err != nil || len(atts) != 0 {
+		t.Fatalf("attachments should be deleted, %+v, %v", atts, err)
+	}
+
+	if err := st.SetEditor(" code --wait "); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := st.Editor(); err != nil || e != "code --wait" {
+		t.Fatalf("unexpected editor, %q, %v", e, err)
+	}
+	if err := st.SetEditor("code 'unclosed"); err == nil {
+		t.Fatal("invalid editor command should be rejected")
+	}
+	if err := st.SetEditor(""); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := st.Editor(); err != nil || e != "" {
+		t.Fatalf("editor should be removed, %q, %v", e, err)
+	}
+
+	if days, err := st.TrashRetention(); err != nil || days != 0 {
+		t.Fatalf("notes should be kept in trash by default, %v, %v", days, err)
+	}
+	if err := st.SetTrashRetention(7); err != nil {
+		t.Fatal(err)
+	}
+	if days, err := st.TrashRetention(); err != nil || days != 7 {
+		t.Fatalf("unexpected retention, %v, %v", days, err)
+	}
+	azure, err := st.CreateNote(Note{Name: "azure", Content: "secret", Ctime: Now(), Utime: Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteNote(azure); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.PurgeExpiredTrash(); err != nil || n != 0 {
+		t.Fatalf("note shouldn't be purged before it expires, %v, %v", n, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "strings"
+
+const (
+	DiffEqual  = ' '
+	DiffDelete = '-'
+	DiffInsert = '+'
+)
+
+type DiffLine struct {
+	Op   byte // DiffEqual, DiffDelete or DiffInsert
+	Text string
+}
+
+// Line diff from a to b based on the longest common subsequence.
+func DiffLines(a string, b string) []DiffLine {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of LCS of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]DiffLine, 0, len(al)+len(bl))
+	i, j := 0, 0
+	for i < len(al) && j < len(bl) {
+		switch {
+		case al[i] == bl[j]:
+			diff = append(diff, DiffLine{DiffEqual, al[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{DiffDelete, al[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{DiffInsert, bl[j]})
+			j++
+		}
+	}
+	for ; i < len(al); i++ {
+		diff = append(diff, DiffLine{DiffDelete, al[i]})
+	}
+	for ; j < len(bl); j++ {
+		diff = append(diff, DiffLine{DiffInsert, bl[j]})
+	}
+	return diff
+}
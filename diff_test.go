@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	diff := DiffLines("a\nb\nc\nd", "a\nc\nd\ne")
+	expected := []DiffLine{
+		{DiffEqual, "a"},
+		{DiffDelete, "b"},
+		{DiffEqual, "c"},
+		{DiffEqual, "d"},
+		{DiffInsert, "e"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("unexpected diff, %+v", diff)
+	}
+
+	diff = DiffLines("pw: 123", "pw: 456")
+	expected = []DiffLine{{DiffDelete, "pw: 123"}, {DiffInsert, "pw: 456"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("unexpected diff, %+v", diff)
+	}
+}
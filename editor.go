@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CKeyEditor      = "Editor" // editor command set in the UI or with 'pocket editor', see ResolveEditor
+	EnvEditor       = "POCKET_EDITOR"
+	EditorFileToken = "{file}"
+	DefaultEditor   = "vim"
+)
+
+var (
+	// vim options that stop vim from leaving copies of the buffer on disk
+	vimSecureOpts = "set nobackup nowritebackup noswapfile noundofile viminfo= | if has('nvim') | set shada= | endif"
+	vimSecureArgs = []string{"-n", "-i", "NONE", "--cmd", vimSecureOpts, "-c", vimSecureOpts}
+
+	emacsSecureArgs = []string{"-Q", "--eval", "(setq make-backup-files nil auto-save-default nil create-lockfiles nil)"}
+
+	// hardening flags by editor executable name, these are prepended to the args, editors not listed (e.g., hx, kak)
+	// don't write swap or backup files by default, while emacsclient simply attaches to the user's emacs server
+	editorSecureArgs = map[string][]string{
+		"vim":   vimSecureArgs,
+		"vi":    vimSecureArgs,
+		"nvim":  vimSecureArgs,
+		"gvim":  append([]string{"-f"}, vimSecureArgs...),
+		"emacs": emacsSecureArgs,
+		"nano":  {"--ignorercfiles"}, // nanorc may enable backups or lock files
+		"micro": {"-backup", "false", "-savecursor", "false", "-saveundo", "false"},
+	}
+
+	_editor       string
+	_editorHarden = true
+)
+
+// Resolve editor command, in the order of: -editor flag, the editor persisted in vault, $POCKET_EDITOR, $VISUAL,
+// $EDITOR and vim.
+func ResolveEditor(persisted string) string {
+	for _, v := range []string{_editor, persisted, os.Getenv(EnvEditor), os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return DefaultEditor
+}
+
+// Editor command persisted in vault, it's empty if not set.
+func (s *SqliteStorage) Editor() (string, error) {
+	v, _, err := GetConfig(s.db, CKeyEditor)
+	return v, err
+}
+
+// Persist the editor command in vault, empty editor removes it.
+func (s *SqliteStorage) SetEditor(editor string) error {
+	editor, err := checkEditor(editor)
+	if err != nil {
+		return err
+	}
+	if editor == "" {
+		if err := s.db.Exec(`DELETE FROM pocket_config WHERE config_key = ?`, CKeyEditor).Error; err != nil {
+			return fmt.Errorf("failed to update pocket_config, %v", err)
+		}
+		return nil
+	}
+	return SetConfig(s.db, CKeyEditor, editor)
+}
+
+func checkEditor(editor string) (string, error) {
+	editor = strings.TrimSpace(editor)
+	if _, err := splitArgs(editor); err != nil {
+		return "", fmt.Errorf("invalid editor command '%v', %v", editor, err)
+	}
+	return editor, nil
+}
+
+// Build the editor command, '{file}' in the editor command is replaced with the path,
+// the path is appended to the end if '{file}' is absent, e.g., 'code --wait {file}' or 'emacsclient -t'.
+func EditorCommand(editor string, path string, harden bool) (*exec.Cmd, error) {
+	args, err := splitArgs(editor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid editor command '%v', %v", editor, err)
+	}
+	if len(args) < 1 {
+		return nil, fmt.Errorf("invalid editor command '%v'", editor)
+	}
+
+	name := args[0]
+	cmdArgs := []string{}
+	if harden {
+		cmdArgs = append(cmdArgs, editorSecureArgs[filepath.Base(name)]...)
+	}
+
+	templated := false
+	for _, a := range args[1:] {
+		if strings.Contains(a, EditorFileToken) {
+			a = strings.ReplaceAll(a, EditorFileToken, path)
+			templated = true
+		}
+		cmdArgs = append(cmdArgs, a)
+	}
+	if !templated {
+		cmdArgs = append(cmdArgs, path)
+	}
+	return exec.Command(name, cmdArgs...), nil
+}
+
+// Split command into args by whitespaces, single or double quoted strings are kept as one arg.
+func splitArgs(s string) ([]string, error) {
+	args := []string{}
+	var quote rune
+	sb := strings.Builder{}
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				sb.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		default:
+			sb.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unclosed quote")
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+	return args, nil
+}
+
+// Create a private (0700) directory for the decrypted buffer, tmpfs is preferred so that nothing hits the disk.
+func secureTempDir() (string, error) {
+	candidates := []string{}
+	if v := os.Getenv("XDG_RUNTIME_DIR"); v != "" {
+		candidates = append(candidates, v)
+	}
+	candidates = append(candidates, "/dev/shm", os.TempDir())
+
+	var lastErr error
+	for _, base := range candidates {
+		if fi, err := os.Stat(base); err != nil || !fi.IsDir() {
+			continue
+		}
+		dir, err := os.MkdirTemp(base, "pocket-*")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			os.RemoveAll(dir)
+			lastErr = err
+			continue
+		}
+		Debugf("Created temp dir %v", dir)
+		return dir, nil
+	}
+	return "", fmt.Errorf("failed to create private temp dir, %v", lastErr)
+}
+
+// Overwrite every file in dir with zeros and remove the dir.
+//
+// This is only best-effort, filesystems like btrfs or SSDs may keep the old blocks around.
+func shredDir(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := shredFile(path, info.Size()); err != nil {
+			Debugf("Failed to shred file %v, %v", path, err)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		Debugf("Failed to remove temp dir %v, %v", dir, err)
+	}
+}
+
+func shredFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zeros := make([]byte, 4096)
+	for n := int64(0); n < size; n += int64(len(zeros)) {
+		if size-n < int64(len(zeros)) {
+			zeros = zeros[:size-n]
+		}
+		if _, err := f.Write(zeros); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// Suspend the app and edit the content in external editor.
+func ExternalEdit(pocket *Pocket, content string, onClose func(s string)) {
+	pocket.Suspend(func() {
+		defer pocket.Touch() // time spent in the editor is not idle time
+
+		dir, err := secureTempDir()
+		if err != nil {
+			PopMsg(pocket, nil, err.Error())
+			return
+		}
+		defer shredDir(dir)
+
+		f, err := os.CreateTemp(dir, "pocket-*") // 0600
+		if err != nil {
+			PopMsg(pocket, nil, "Failed to create temp file, %v", err)
+			return
+		}
+		defer f.Close()
+
+		if _, err := f.WriteString(content); err != nil {
+			PopMsg(pocket, nil, "Failed to write to temp file, %v", err)
+			return
+		}
+
+		persisted, err := pocket.Storage.Editor()
+		if err != nil {
+			Debugf("Failed to load editor, %v", err)
+		}
+		editor := ResolveEditor(persisted)
+		cmd, err := EditorCommand(editor, f.Name(), _editorHarden)
+		if err != nil {
+			PopMsg(pocket, nil, err.Error())
+			return
+		}
+		Debugf("Launching editor %v", cmd.Args)
+
+		// for term control
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+
+		if err := cmd.Run(); err != nil {
+			PopMsg(pocket, nil, "Failed to launch %v, %v", editor, err)
+			return
+		}
+
+		out, err := os.ReadFile(f.Name())
+		if err != nil {
+			PopMsg(pocket, nil, "Failed to read from temp file, %v", err)
+			return
+		}
+
+		if out != nil {
+			onClose(string(out))
+		} else {
+			onClose("")
+		}
+	})
+}
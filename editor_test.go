@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditorCommand(t *testing.T) {
+	cases := []struct {
+		editor string
+		harden bool
+		args   []string
+	}{
+		{"vim", false, []string{"vim", "/tmp/f"}},
+		{"hx", true, []string{"hx", "/tmp/f"}},
+		{"code --wait {file}", true, []string{"code", "--wait", "/tmp/f"}},
+		{`emacsclient -t -a ""`, true, []string{"emacsclient", "-t", "-a", "", "/tmp/f"}},
+		{"'/opt/my editor/bin/nano' +1", true, []string{"/opt/my editor/bin/nano", "--ignorercfiles", "+1", "/tmp/f"}},
+		{"/usr/bin/vim", true, append(append([]string{"/usr/bin/vim"}, vimSecureArgs...), "/tmp/f")},
+	}
+	for _, c := range cases {
+		cmd, err := EditorCommand(c.editor, "/tmp/f", c.harden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cmd.Args, c.args) {
+			t.Fatalf("'%v', expected: %q, actual: %q", c.editor, c.args, cmd.Args)
+		}
+	}
+
+	if _, err := EditorCommand("vim 'abc", "/tmp/f", true); err == nil {
+		t.Fatal("should fail with unclosed quote")
+	}
+}
+
+func TestResolveEditor(t *testing.T) {
+	t.Setenv(EnvEditor, "")
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "nano")
+	if e := ResolveEditor(""); e != "nano" {
+		t.Fatalf("unexpected editor, %v", e)
+	}
+	if e := ResolveEditor("hx"); e != "hx" {
+		t.Fatalf("persisted editor should be used before env, %v", e)
+	}
+	_editor = "code --wait"
+	defer func() { _editor = "" }()
+	if e := ResolveEditor("hx"); e != "code --wait" {
+		t.Fatalf("-editor flag should be used first, %v", e)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FieldText     = "text"
+	FieldUsername = "username"
+	FieldPassword = "password"
+	FieldURL      = "url"
+	FieldTOTP     = "totp"
+)
+
+// Supported types of note fields.
+var FieldTypes = []string{FieldText, FieldUsername, FieldPassword, FieldURL, FieldTOTP}
+
+// Typed custom field of a note, e.g., the username, password and url of a login entry.
+type NoteField struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret"` // secret fields are masked by default
+}
+
+func IsFieldType(t string) bool {
+	for _, ft := range FieldTypes {
+		if ft == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether fields of the type are secret by default.
+func IsSecretFieldType(t string) bool {
+	return t == FieldPassword || t == FieldTOTP
+}
+
+func ValidateFields(fields []NoteField) error {
+	seen := map[string]struct{}{}
+	for _, f := range fields {
+		if strings.TrimSpace(f.Name) == "" {
+			return fmt.Errorf("field name can't be empty")
+		}
+		if !IsFieldType(f.Type) {
+			return fmt.Errorf("unknown field type '%v'", f.Type)
+		}
+		if f.Type == FieldTOTP {
+			if _, err := ParseTOTP(f.Value); err != nil {
+				return fmt.Errorf("invalid totp field '%v', %v", f.Name, err)
+			}
+		}
+		if _, ok := seen[f.Name]; ok {
+			return fmt.Errorf("duplicate field '%v'", f.Name)
+		}
+		seen[f.Name] = struct{}{}
+	}
+	return nil
+}
+
+func FieldsEqual(a []NoteField, b []NoteField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Find field of the type, returns false if not found.
+func FindField(fields []NoteField, typ string) (NoteField, bool) {
+	for _, f := range fields {
+		if f.Type == typ {
+			return f, true
+		}
+	}
+	return NoteField{}, false
+}
+
+// Fields are stored in a separate table, both name and value are encrypted, seq keeps the order of fields.
+func createFieldTable(tx *gorm.DB) error {
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_note_field (
+			note_id INTEGER NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			value TEXT NOT NULL,
+			secret INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (note_id, seq)
+		)
+	`).Error
+	return err
+}
+
+type fieldRow struct {
+	NoteId int
+	Seq    int
+	Name   string
+	Type   string
+	Value  string
+	Secret bool
+}
+
+// Replace fields of the note.
+func setNoteFields(tx *gorm.DB, noteId int, fields []NoteField) error {
+	if err := ValidateFields(fields); err != nil {
+		return err
+	}
+	if err := deleteFields(tx, noteId); err != nil {
+		return err
+	}
+	for i, f := range fields {
+		name, value, err := encryptPair(f.Name, fieldAD(noteId, i, f.Type, f.Secret, "name"), f.Value, fieldAD(noteId, i, f.Type, f.Secret, "value"))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt field, %v", err)
+		}
+		err = tx.Exec(`INSERT INTO pocket_note_field (note_id, seq, name, type, value, secret) VALUES (?,?,?,?,?,?)`,
+			noteId, i, name, f.Type, value, f.Secret).Error
+		if err != nil {
+			return fmt.Errorf("failed to save pocket_note_field, %v", err)
+		}
+	}
+	return nil
+}
+
+// Name and value of field are bound to the note, the position, the type and whether the field is secret, type and
+// secret are stored in plaintext, but they can't be changed (e.g., to unmask a password field) without being detected.
+func fieldAD(noteId int, seq int, typ string, secret bool, column string) string {
+	return rowAD("pocket_note_field", column, noteId, seq) + ":" + typ + ":" + strconv.FormatBool(secret)
+}
+
+// Load fields of the notes, fields are decrypted using decrypt, e.g., DecryptBound.
+func loadNoteFields(db *gorm.DB, decrypt decryptFunc, notes []Note) error {
+	if len(notes) < 1 {
+		return nil
+	}
+	ids := make([]int, 0, len(notes))
+	for _, n := range notes {
+		ids = append(ids, n.Id)
+	}
+
+	var rows []fieldRow
+	err := db.Raw(`SELECT note_id, seq, name, type, value, secret FROM pocket_note_field WHERE note_id IN ? ORDER BY note_id, seq`, ids).
+		Scan(&rows).Error
+	if err != nil {
+		return fmt.Errorf("failed to query note fields, %v", err)
+	}
+
+	byNote := map[int][]NoteField{}
+	for _, r := range rows {
+		f := NoteField{Type: r.Type, Secret: r.Secret}
+		f.Name, f.Value, err = decryptPair(decrypt, r.Name, fieldAD(r.NoteId, r.Seq, r.Type, r.Secret, "name"),
+			r.Value, fieldAD(r.NoteId, r.Seq, r.Type, r.Secret, "value"))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt field of note %v, %w", r.NoteId, err)
+		}
+		byNote[r.NoteId] = append(byNote[r.NoteId], f)
+	}
+	for i := range notes {
+		notes[i].Fields = byNote[notes[i].Id]
+	}
+	return nil
+}
+
+func deleteFields(tx *gorm.DB, noteId int) error {
+	if err := tx.Exec(`DELETE FROM pocket_note_field WHERE note_id = ?`, noteId).Error; err != nil {
+		return fmt.Errorf("failed to delete pocket_note_field, %v", err)
+	}
+	return nil
+}
+
+// Bind all fields to their rows, see bindCiphertext.
+func bindFields(tx *gorm.DB) error {
+	var rows []fieldRow
+	if err := tx.Raw(`SELECT note_id, seq, name, type, value, secret FROM pocket_note_field`).Scan(&rows).Error; err != nil {
+		return fmt.Errorf("failed to query pocket_note_field, %v", err)
+	}
+	var err error
+	for _, r := range rows {
+		if r.Name, err = rebind(r.Name, fieldAD(r.NoteId, r.Seq, r.Type, r.Secret, "name")); err != nil {
+			return fmt.Errorf("failed to re-encrypt field of note %v, %v", r.NoteId, err)
+		}
+		if r.Value, err = rebind(r.Value, fieldAD(r.NoteId, r.Seq, r.Type, r.Secret, "value")); err != nil {
+			return fmt.Errorf("failed to re-encrypt field of note %v, %v", r.NoteId, err)
+		}
+		err = tx.Exec(`UPDATE pocket_note_field SET name = ?, value = ? WHERE note_id = ? AND seq = ?`, r.Name, r.Value, r.NoteId, r.Seq).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_note_field, %v", err)
+		}
+	}
+	return nil
+}
+
+// Re-encrypt all fields with the new key, see ReencryptVault.
+func reencryptFields(tx *gorm.DB, oldKey []byte, newKey []byte) error {
+	if ok, err := tableExists(tx, "pocket_note_field"); err != nil || !ok {
+		return err
+	}
+	var rows []fieldRow
+	if err := tx.Raw(`SELECT note_id, seq, name, value FROM pocket_note_field`).Scan(&rows).Error; err != nil {
+		return fmt.Errorf("failed to query pocket_note_field, %v", err)
+	}
+	var err error
+	for _, r := range rows {
+		for _, v := range []*string{&r.Name, &r.Value} {
+			if *v, err = reencrypt(oldKey, newKey, *v); err != nil {
+				return fmt.Errorf("failed to re-encrypt field of note %v, %v", r.NoteId, err)
+			}
+		}
+		err = tx.Exec(`UPDATE pocket_note_field SET name = ?, value = ? WHERE note_id = ? AND seq = ?`, r.Name, r.Value, r.NoteId, r.Seq).Error
+		if err != nil {
+			return fmt.Errorf("failed to update pocket_note_field, %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultPasswordLength  = 20
+	DefaultPassphraseWords = 6
+	MaxPasswordLength      = 1024
+	MaxPassphraseWords     = 64
+
+	lowerChars  = "abcdefghijklmnopqrstuvwxyz"
+	upperChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars  = "0123456789"
+	symbolChars = "!@#$%^&*()-_=+[]{};:,.<>/?~"
+
+	// characters that are easily confused with each other
+	ambiguousChars = "Il1O0o|`'\";:.,{}[]()/\\"
+)
+
+// EFF's large word list for diceware passphrase, see https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases
+//
+//go:embed eff_large_wordlist.txt
+var effWordListTxt string
+
+var (
+	effWordListOnce sync.Once
+	effWords        []string
+)
+
+func effWordList() []string {
+	effWordListOnce.Do(func() {
+		lines := strings.Split(strings.TrimSpace(effWordListTxt), "\n")
+		effWords = make([]string, 0, len(lines))
+		for _, l := range lines {
+			if _, w, ok := strings.Cut(l, "\t"); ok {
+				effWords = append(effWords, strings.TrimSpace(w))
+			}
+		}
+	})
+	return effWords
+}
+
+type PasswordOptions struct {
+	Length           int
+	Lower            bool
+	Upper            bool
+	Digits           bool
+	Symbols          bool
+	ExcludeAmbiguous bool
+}
+
+func DefaultPasswordOptions() PasswordOptions {
+	return PasswordOptions{Length: DefaultPasswordLength, Lower: true, Upper: true, Digits: true, Symbols: true}
+}
+
+type PassphraseOptions struct {
+	Words     int
+	Separator string
+}
+
+// Random int in [0, n) using crypto/rand.
+func randInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(fmt.Errorf("failed to read random number, %v", err))
+	}
+	return int(v.Int64())
+}
+
+// Generate random password, it contains at least one character of each selected class.
+func GeneratePassword(o PasswordOptions) (string, error) {
+	classes := []string{}
+	for _, c := range []struct {
+		on  bool
+		set string
+	}{{o.Lower, lowerChars}, {o.Upper, upperChars}, {o.Digits, digitChars}, {o.Symbols, symbolChars}} {
+		if !c.on {
+			continue
+		}
+		set := c.set
+		if o.ExcludeAmbiguous {
+			set = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(ambiguousChars, r) {
+					return -1
+				}
+				return r
+			}, set)
+		}
+		classes = append(classes, set)
+	}
+	if len(classes) < 1 {
+		return "", errors.New("at least one character class should be selected")
+	}
+	if o.Length < len(classes) {
+		return "", fmt.Errorf("password length should be at least %v", len(classes))
+	}
+	if o.Length > MaxPasswordLength {
+		return "", fmt.Errorf("password length should be at most %v", MaxPasswordLength)
+	}
+
+	all := strings.Join(classes, "")
+	b := make([]rune, 0, o.Length)
+	for _, set := range classes {
+		b = append(b, rune(set[randInt(len(set))]))
+	}
+	for len(b) < o.Length {
+		b = append(b, rune(all[randInt(len(all))]))
+	}
+	// shuffle, so that the guaranteed characters are not always at the beginning
+	for i := len(b) - 1; i > 0; i-- {
+		j := randInt(i + 1)
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b), nil
+}
+
+// Generate diceware passphrase with words picked from EFF's large word list.
+func GeneratePassphrase(o PassphraseOptions) (string, error) {
+	if o.Words < 1 {
+		return "", errors.New("number of words should be at least 1")
+	}
+	if o.Words > MaxPassphraseWords {
+		return "", fmt.Errorf("number of words should be at most %v", MaxPassphraseWords)
+	}
+	list := effWordList()
+	words := make([]string, 0, o.Words)
+	for i := 0; i < o.Words; i++ {
+		words = append(words, list[randInt(len(list))])
+	}
+	return strings.Join(words, o.Separator), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		pw, err := GeneratePassword(PasswordOptions{Length: 8, Lower: true, Upper: true, Digits: true, Symbols: true, ExcludeAmbiguous: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pw) != 8 || strings.ContainsAny(pw, ambiguousChars) {
+			t.Fatalf("unexpected password, %v", pw)
+		}
+		for _, set := range []string{lowerChars, upperChars, digitChars, symbolChars} {
+			if !strings.ContainsAny(pw, set) {
+				t.Fatalf("password should contain one of '%v', %v", set, pw)
+			}
+		}
+	}
+
+	if pw, err := GeneratePassword(PasswordOptions{Length: 30, Digits: true}); err != nil || strings.Trim(pw, digitChars) != "" {
+		t.Fatalf("unexpected password, %v, %v", pw, err)
+	}
+	if _, err := GeneratePassword(PasswordOptions{Length: 30}); err == nil {
+		t.Fatal("should fail without character class")
+	}
+	if _, err := GeneratePassword(PasswordOptions{Length: 1, Lower: true, Upper: true}); err == nil {
+		t.Fatal("should fail when length is too short")
+	}
+	if pw, err := GeneratePassword(PasswordOptions{Length: MaxPasswordLength, Lower: true}); err != nil || len(pw) != MaxPasswordLength {
+		t.Fatalf("unexpected password, %v, %v", len(pw), err)
+	}
+	if _, err := GeneratePassword(PasswordOptions{Length: MaxPasswordLength + 1, Lower: true}); err == nil {
+		t.Fatal("should fail when length is too long")
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	if n := len(effWordList()); n != 7776 {
+		t.Fatalf("unexpected number of words, %v", n)
+	}
+	pp, err := GeneratePassphrase(PassphraseOptions{Words: 5, Separator: " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.Fields(pp)) != 5 {
+		t.Fatalf("unexpected passphrase, %v", pp)
+	}
+	if _, err := GeneratePassphrase(PassphraseOptions{}); err == nil {
+		t.Fatal("should fail without words")
+	}
+	if _, err := GeneratePassphrase(PassphraseOptions{Words: MaxPassphraseWords + 1}); err == nil {
+		t.Fatal("should fail with too many words")
+	}
+}
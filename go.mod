@@ -7,6 +7,9 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/rivo/tview v0.0.0-20240307173318-e804876934a1
 	github.com/spf13/cast v1.6.0
+	golang.org/x/crypto v0.18.0
+	golang.org/x/sys v0.17.0
+	golang.org/x/term v0.17.0
 	gorm.io/driver/sqlite v1.4.3
 	gorm.io/gorm v1.24.7-0.20230306060331-85eaf9eeda11
 )
@@ -18,7 +21,5 @@ require (
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.17.0 // indirect
-	golang.org/x/term v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
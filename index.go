@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metaIndexEntry struct {
+	Id   int
+	Name string
+	Desc string
+}
+
+// In-memory index of decrypted note names and descriptions.
+//
+// When metadata encryption is enabled, FTS can no longer match the encrypted name and desc,
+// so the index is built after unlock and keyword matching is done in memory instead.
+type MetaIndex struct {
+	sync.RWMutex
+	built   bool
+	entries []metaIndexEntry // sorted by id DESC
+}
+
+func (m *MetaIndex) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.built = false
+	m.entries = nil
+}
+
+func (m *MetaIndex) Built() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.built
+}
+
+func (m *MetaIndex) Build(notes []Note) {
+	entries := make([]metaIndexEntry, 0, len(notes))
+	for _, n := range notes {
+		entries = append(entries, metaIndexEntry{Id: n.Id, Name: n.Name, Desc: n.Desc})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id > entries[j].Id })
+
+	m.Lock()
+	defer m.Unlock()
+	m.entries = entries
+	m.built = true
+}
+
+func (m *MetaIndex) Put(n Note) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.built {
+		return
+	}
+	e := metaIndexEntry{Id: n.Id, Name: n.Name, Desc: n.Desc}
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].Id <= n.Id })
+	if i < len(m.entries) && m.entries[i].Id == n.Id {
+		m.entries[i] = e
+		return
+	}
+	m.entries = append(m.entries, metaIndexEntry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = e
+}
+
+func (m *MetaIndex) Remove(id int) {
+	m.Lock()
+	defer m.Unlock()
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].Id <= id })
+	if i < len(m.entries) && m.entries[i].Id == id {
+		m.entries = append(m.entries[:i], m.entries[i+1:]...)
+	}
+}
+
+// Find ids of notes matching the keyword, returns total number of matched notes and ids at the page (1-based).
+//
+// If filter is not nil, only notes accepted by the filter are matched.
+func (m *MetaIndex) Match(page int, limit int, kw string, filter func(id int) bool) (int, []int) {
+	m.RLock()
+	defer m.RUnlock()
+
+	q := ParseMatchQuery(kw)
+	total := 0
+	offset := (page - 1) * limit
+	ids := []int{}
+	for _, e := range m.entries {
+		if !q.Match(e.Name) && !q.Match(e.Desc) {
+			continue
+		}
+		if filter != nil && !filter(e.Id) {
+			continue
+		}
+		if total >= offset && len(ids) < limit {
+			ids = append(ids, e.Id)
+		}
+		total += 1
+	}
+	return total, ids
+}
+
+// Simplified FTS-like query, terms are ANDed unless separated by OR, e.g., 'aws AND prod OR gcp'.
+type MatchQuery [][]string
+
+func ParseMatchQuery(kw string) MatchQuery {
+	q := MatchQuery{}
+	group := []string{}
+	for _, t := range strings.Fields(kw) {
+		switch t {
+		case "OR":
+			if len(group) > 0 {
+				q = append(q, group)
+			}
+			group = []string{}
+		case "AND":
+			continue
+		default:
+			t = strings.ToLower(strings.Trim(t, `"*`))
+			if t != "" {
+				group = append(group, t)
+			}
+		}
+	}
+	if len(group) > 0 {
+		q = append(q, group)
+	}
+	return q
+}
+
+func (q MatchQuery) Match(s string) bool {
+	if len(q) < 1 {
+		return true
+	}
+	s = strings.ToLower(s)
+	for _, group := range q {
+		matched := true
+		for _, t := range group {
+			if !strings.Contains(s, t) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
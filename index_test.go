@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestMatchQuery(t *testing.T) {
+	cases := []struct {
+		kw    string
+		s     string
+		match bool
+	}{
+		{"", "anything", true},
+		{"aws", "AWS prod", true},
+		{"aws prod", "aws prod", true},
+		{"aws AND prod", "aws dev", false},
+		{"aws OR gcp", "gcp dev", true},
+		{"aws prod OR gcp dev", "gcp prod", false},
+		{"pro*", "prod", true},
+	}
+	for _, c := range cases {
+		if m := ParseMatchQuery(c.kw).Match(c.s); m != c.match {
+			t.Fatalf("'%v' match '%v', expected: %v, actual: %v", c.kw, c.s, c.match, m)
+		}
+	}
+}
+
+func TestMetaIndex(t *testing.T) {
+	idx := &MetaIndex{}
+	idx.Build([]Note{{Id: 1, Name: "aws"}, {Id: 3, Name: "gcp"}})
+	idx.Put(Note{Id: 2, Name: "aws prod"})
+	idx.Put(Note{Id: 3, Name: "azure"})
+
+	total, ids := idx.Match(1, 5, "", nil)
+	if total != 3 || len(ids) != 3 || ids[0] != 3 || ids[1] != 2 || ids[2] != 1 {
+		t.Fatalf("unexpected result, %v, %v", total, ids)
+	}
+
+	total, ids = idx.Match(2, 1, "aws", nil)
+	if total != 2 || len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("unexpected result, %v, %v", total, ids)
+	}
+
+	total, ids = idx.Match(1, 5, "", func(id int) bool { return id != 2 })
+	if total != 2 || len(ids) != 2 || ids[0] != 3 || ids[1] != 1 {
+		t.Fatalf("unexpected result, %v, %v", total, ids)
+	}
+
+	idx.Remove(2)
+	total, _ = idx.Match(1, 5, "aws", nil)
+	if total != 1 {
+		t.Fatalf("unexpected total, %v", total)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CKeyKeyFile = "KeyFile" // check value of the key file, only present if the vault requires one
+
+	KeyFileLen = 64
+)
+
+var (
+	ErrKeyFileRequired = errors.New("vault requires key file, specify it with -keyfile")
+	ErrKeyFileWrong    = errors.New("key file is incorrect")
+	ErrKeyFileUnused   = errors.New("vault doesn't use key file, remove -keyfile")
+
+	// path of the key file combined with the password, see -keyfile
+	_keyFile = ""
+)
+
+// Generate key file with random bytes, existing file is never overwritten.
+func NewKeyFile(path string) error {
+	b := make([]byte, KeyFileLen)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return fmt.Errorf("failed to generate key file, %v", err)
+	}
+	defer wipeBytes(b)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file, %v", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write key file, %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write key file, %v", err)
+	}
+	return nil
+}
+
+// Read key file and hash its content, any non-empty file can be used as key file. Returns nil if path is empty.
+func ReadKeyFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("key file %v not found", path)
+		}
+		return nil, fmt.Errorf("failed to read key file, %v", err)
+	}
+	defer wipeBytes(b)
+	if len(b) < 1 {
+		return nil, fmt.Errorf("key file %v is empty", path)
+	}
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+// Value stored in pocket_config to tell whether the key file is the right one before deriving the key.
+func keyFileCheck(keyFile []byte) string {
+	mac := hmac.New(sha256.New, keyFile)
+	mac.Write([]byte(CKeyKeyFile))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Combine password with the key file, the result is the secret of the password key slot, so both of them are
+// required to derive the key.
+func keyFileSecret(pw string, keyFile []byte) string {
+	if keyFile == nil {
+		return pw
+	}
+	return pw + "\x00" + hex.EncodeToString(keyFile)
+}
+
+// Read the key file that the vault requires, returns nil if the vault doesn't use one.
+func vaultKeyFile(db *gorm.DB, path string) ([]byte, error) {
+	check, required, err := GetConfig(db, CKeyKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if !required {
+		if path != "" {
+			return nil, ErrKeyFileUnused
+		}
+		return nil, nil
+	}
+	if path == "" {
+		return nil, ErrKeyFileRequired
+	}
+	keyFile, err := ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(keyFileCheck(keyFile)), []byte(check)) {
+		return nil, ErrKeyFileWrong
+	}
+	return keyFile, nil
+}
+
+// Set the key file of the vault (or remove it if path is empty), the password key slot is rewritten.
+func (s *SqliteStorage) ChangeKeyFile(pw string, path string) error {
+	keyFile, err := ReadKeyFile(path)
+	if err != nil {
+		return err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		key, err := verifyVaultKey(tx, pw)
+		if err != nil {
+			return err
+		}
+		defer wipeBytes(key)
+		slot, err := NewKeySlot(keyFileSecret(pw, keyFile), key)
+		if err != nil {
+			return err
+		}
+		if err := SetConfig(tx, CKeyPwSlot, slot.String()); err != nil {
+			return err
+		}
+		if keyFile == nil {
+			return tx.Exec(`DELETE FROM pocket_config WHERE config_key = ?`, CKeyKeyFile).Error
+		}
+		return SetConfig(tx, CKeyKeyFile, keyFileCheck(keyFile))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to change key file, %v", err)
+	}
+	return nil
+}
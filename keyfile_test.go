@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	kf, other := filepath.Join(dir, "pocket.key"), filepath.Join(dir, "other.key")
+	for _, f := range []string{kf, other} {
+		if err := NewKeyFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewKeyFile(kf); err == nil {
+		t.Fatal("existing key file shouldn't be overwritten")
+	}
+
+	_keyFile = kf
+	t.Cleanup(func() { _keyFile = "" })
+	st := newTestSqliteStorage(t)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		keyFile string
+		err     error
+	}{{"", ErrKeyFileRequired}, {other, ErrKeyFileWrong}} {
+		_keyFile = c.keyFile
+		st.LockVault()
+		if _, err := st.CheckPassword("mypassword"); err != c.err {
+			t.Fatalf("expected %v, got %v", c.err, err)
+		}
+	}
+	_keyFile = filepath.Join(dir, "missing.key")
+	if _, err := st.CheckPassword("mypassword"); err == nil {
+		t.Fatal("missing key file should be rejected")
+	}
+	_keyFile = kf
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.ChangePassword("mypassword", "mypassword2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.CheckPassword("mypassword2"); err != nil || !ok {
+		t.Fatal("key file should be kept after changing password", ok, err)
+	}
+
+	if err := st.ChangeKeyFile("mypassword2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CheckPassword("mypassword2"); err != ErrKeyFileUnused {
+		t.Fatalf("expected %v, got %v", ErrKeyFileUnused, err)
+	}
+	_keyFile = ""
+	if ok, err := st.CheckPassword("mypassword2"); err != nil || !ok {
+		t.Fatal("only password should be required", ok, err)
+	}
+}
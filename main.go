@@ -2,14 +2,29 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"strings"
 )
 
 var (
-	_debug    = flag.Bool("debug", false, "enable debug log")
-	_database = flag.String("db", "", "sqlite database file, default to $HOME/pocket")
+	_debug       = flag.Bool("debug", false, "enable debug log")
+	_database    = flag.String("db", "", "sqlite database file, default to $HOME/pocket")
+	_flagKeyFile = flag.String("keyfile", "", "key file required together with the password to unlock the vault, see 'pocket keyfile'")
+
+	_flagEditor       = flag.String("editor", "", "editor command, e.g., 'nvim' or 'code --wait {file}', default to $POCKET_EDITOR, $VISUAL, $EDITOR or vim")
+	_flagEditorHarden = flag.Bool("editor-harden", true, "launch editor with flags that disable swap, backup and undo files")
+
+	_flagClipTimeout = flag.Duration("clip-timeout", DefaultClipTimeout, "clear the copied secret from clipboard after the timeout, 0 to never clear it")
+	_flagLockTimeout = flag.Duration("lock-timeout", DefaultLockTimeout, "lock the vault after being idle for the timeout, 0 to never lock it")
+
+	_passwordFd = flag.Int("password-fd", -1, "read password from the file descriptor instead of prompting for it, only used by commands")
+
+	_flagKdfTime    = flag.Uint("kdf-time", DefaultKdfTime, "argon2id iterations used when deriving key for new vault")
+	_flagKdfMemory  = flag.Uint("kdf-memory", DefaultKdfMemory, "argon2id memory (KiB) used when deriving key for new vault")
+	_flagKdfThreads = flag.Uint("kdf-threads", DefaultKdfThreads, "argon2id parallelism used when deriving key for new vault")
 )
 
 var (
@@ -19,8 +34,39 @@ var (
 )
 
 func main() {
+	setNonDumpable()
+
+	// deferred functions also run when main panics, the key must not outlive the process in any case
+	defer cleanup()
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: pocket [flags] [command]\n\nFlags:\n")
+		flag.PrintDefaults()
+		PrintCliUsage()
+	}
 	flag.Parse()
 
+	_keyFile = *_flagKeyFile
+	_editor = *_flagEditor
+	_editorHarden = *_flagEditorHarden
+	_clipTimeout = *_flagClipTimeout
+	_lockTimeout = *_flagLockTimeout
+	if *_flagKdfTime < 1 || *_flagKdfTime > MaxKdfTime {
+		fmt.Fprintf(os.Stderr, "-kdf-time should be within 1..%d\n", MaxKdfTime)
+		os.Exit(2)
+	}
+	_kdfTime = uint32(*_flagKdfTime)
+	if *_flagKdfThreads < 1 || *_flagKdfThreads > math.MaxUint8 {
+		fmt.Fprintf(os.Stderr, "-kdf-threads should be within 1..%d\n", math.MaxUint8)
+		os.Exit(2)
+	}
+	_kdfThreads = uint8(*_flagKdfThreads)
+	if *_flagKdfMemory < 8**_flagKdfThreads || *_flagKdfMemory > MaxKdfMemory {
+		fmt.Fprintf(os.Stderr, "-kdf-memory should be within %d..%d (8 KiB per thread)\n", 8**_flagKdfThreads, MaxKdfMemory)
+		os.Exit(2)
+	}
+	_kdfMemory = uint32(*_flagKdfMemory)
+
 	if *_debug {
 		_debugLogFile, _ = os.Create("debug.log")
 		defer _debugLogFile.Close()
@@ -59,15 +105,33 @@ func main() {
 		*_database = pdir + sp + "pocket.db"
 	}
 
-	if err := OpenDB(*_database, *_debug, _debugLogFile); err != nil {
+	db, err := OpenDB(*_database, *_debug, _debugLogFile)
+	if err != nil {
 		panic(err)
 	}
+	st := NewSqliteStorage(db, *_database)
 
-	if err := NewApp().Run(); err != nil {
+	if ok, err := RunCli(st, flag.Args()); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			cleanup() // os.Exit doesn't run deferred functions
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = NewApp(st).Run()
+	if err != nil {
 		panic(err)
 	}
 }
 
+// Wipe the key and clear the clipboard before exit.
+func cleanup() {
+	WipeKey()
+	ClearClipboard()
+}
+
 func Debugf(fmt string, args ...any) {
 	if _debugLogPipe == nil {
 		return
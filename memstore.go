@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-memory Storage, nothing is encrypted or persisted, it's mainly used for testing.
+type MemStorage struct {
+	sync.RWMutex
+	password    string
+	unlocked    bool
+	encryptMeta bool
+	notes       map[int]Note
+	nextId      int
+	revisions   map[int][]Revision // latest revision first
+	nextRevId   int
+	trash       map[int]ETime // note id -> deletion time
+	trashDays   int
+	attachments map[int]Attachment
+	nextAttId   int
+	recovery    map[string]struct{}
+	editor      string
+}
+
+var _ Storage = (*MemStorage)(nil)
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{notes: map[int]Note{}, nextId: 1, revisions: map[int][]Revision{}, nextRevId: 1,
+		trash: map[int]ETime{}, trashDays: DefaultTrashDays, attachments: map[int]Attachment{}, nextAttId: 1}
+}
+
+func (m *MemStorage) VaultExists() (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.password != "", nil
+}
+
+func (m *MemStorage) CheckPassword(pw string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.password == "" {
+		m.password = pw
+	}
+	m.unlocked = m.password == pw
+	return m.unlocked, nil
+}
+
+func (m *MemStorage) ChangePassword(oldPw string, newPw string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.password == "" {
+		return errors.New("vault is not initialized yet")
+	}
+	if m.password != oldPw {
+		return errors.New("password incorrect")
+	}
+	m.password = newPw
+	return nil
+}
+
+func (m *MemStorage) ChangeKeyFile(pw string, path string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.password != pw {
+		return errors.New("password incorrect")
+	}
+	_, err := ReadKeyFile(path)
+	return err
+}
+
+func (m *MemStorage) GenerateRecoveryCodes() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.unlocked {
+		return nil, ErrVaultLocked
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	m.recovery = map[string]struct{}{}
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := newRecoveryCode()
+		codes = append(codes, code)
+		m.recovery[normalizeRecoveryCode(code)] = struct{}{}
+	}
+	return codes, nil
+}
+
+func (m *MemStorage) RecoverPassword(code string, newPw string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	code = normalizeRecoveryCode(code)
+	if _, ok := m.recovery[code]; !ok {
+		return 0, ErrRecoveryCodeWrong
+	}
+	delete(m.recovery, code)
+	m.password = newPw
+	m.unlocked = true
+	return len(m.recovery), nil
+}
+
+func (m *MemStorage) LockVault() {
+	m.Lock()
+	defer m.Unlock()
+	m.unlocked = false
+}
+
+func (m *MemStorage) InitSchema() error {
+	return nil
+}
+
+func (m *MemStorage) FetchNotes(nq NoteQuery) (int, []Note, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	q := ParseMatchQuery(nq.Keyword)
+	matched := []Note{}
+	for _, n := range m.notes {
+		if _, ok := m.trash[n.Id]; ok {
+			continue
+		}
+		if !HasTags(n, nq.Tags) || !InNotebook(n.Notebook, nq.Notebook) {
+			continue
+		}
+		if q.Match(n.Name) || q.Match(n.Desc) {
+			matched = append(matched, n)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Id > matched[j].Id })
+
+	offset := (nq.Page - 1) * nq.Limit
+	if offset >= len(matched) {
+		return len(matched), []Note{}, nil
+	}
+	end := offset + nq.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return len(matched), matched[offset:end], nil
+}
+
+func (m *MemStorage) FetchNote(id int) (Note, error) {
+	m.RLock()
+	defer m.RUnlock()
+	n, ok := m.notes[id]
+	if !ok {
+		return Note{}, ErrNoteNotFound
+	}
+	if _, ok := m.trash[id]; ok {
+		return Note{}, ErrNoteInTrash
+	}
+	return n, nil
+}
+
+func (m *MemStorage) CreateNote(note Note) (Note, error) {
+	if err := ValidateFields(note.Fields); err != nil {
+		return Note{}, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	note.Id = m.nextId
+	note.Notebook = NormalizeNotebook(note.Notebook)
+	note.Fields = append([]NoteField(nil), note.Fields...)
+	m.nextId += 1
+	m.notes[note.Id] = note
+	return note, nil
+}
+
+func (m *MemStorage) UpdateNote(note Note) error {
+	if err := ValidateFields(note.Fields); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	prev, ok := m.notes[note.Id]
+	if !ok {
+		return ErrNoteNotFound
+	}
+	if prev.Name != note.Name || prev.Desc != note.Desc || prev.Content != note.Content || !FieldsEqual(prev.Fields, note.Fields) {
+		r := Revision{Id: m.nextRevId, NoteId: prev.Id, Name: prev.Name, Desc: prev.Desc, Content: prev.Content,
+			Fields: append([]NoteField{}, prev.Fields...), Utime: prev.Utime, Rtime: Now()}
+		m.nextRevId += 1
+		m.revisions[prev.Id] = append([]Revision{r}, m.revisions[prev.Id]...)
+	}
+	note.Notebook = prev.Notebook
+	note.Fields = append([]NoteField(nil), note.Fields...)
+	m.notes[note.Id] = note
+	return nil
+}
+
+func (m *MemStorage) FetchRevisions(noteId int) ([]Revision, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]Revision{}, m.revisions[noteId]...), nil
+}
+
+func (m *MemStorage) RestoreRevision(noteId int, revId int) (Note, error) {
+	revs, _ := m.FetchRevisions(noteId)
+	for _, r := range revs {
+		if r.Id != revId {
+			continue
+		}
+		n, err := m.FetchNote(noteId)
+		if err != nil {
+			return Note{}, err
+		}
+		n.Name, n.Desc, n.Content, n.Fields, n.Utime = r.Name, r.Desc, r.Content, r.Fields, Now()
+		return n, m.UpdateNote(n)
+	}
+	return Note{}, ErrRevisionNotFound
+}
+
+func (m *MemStorage) DeleteNote(note Note) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.notes[note.Id]; ok {
+		if _, ok := m.trash[note.Id]; !ok {
+			m.trash[note.Id] = Now()
+		}
+	}
+	return nil
+}
+
+func (m *MemStorage) FetchTrash() ([]TrashedNote, error) {
+	m.RLock()
+	defer m.RUnlock()
+	trashed := []TrashedNote{}
+	for id, dtime := range m.trash {
+		trashed = append(trashed, TrashedNote{Note: m.notes[id], Dtime: dtime})
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		ti, tj := trashed[i].Dtime.ToTime(), trashed[j].Dtime.ToTime()
+		if ti.Equal(tj) {
+			return trashed[i].Id > trashed[j].Id
+		}
+		return ti.After(tj)
+	})
+	return trashed, nil
+}
+
+func (m *MemStorage) RestoreNote(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.trash[id]; !ok {
+		return ErrNoteNotInTrash
+	}
+	delete(m.trash, id)
+	return nil
+}
+
+func (m *MemStorage) PurgeNote(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.trash[id]; !ok {
+		return ErrNoteNotInTrash
+	}
+	m.purgeNote(id)
+	return nil
+}
+
+func (m *MemStorage) purgeNote(id int) {
+	delete(m.notes, id)
+	delete(m.revisions, id)
+	delete(m.trash, id)
+	for aid, a := range m.attachments {
+		if a.NoteId == id {
+			delete(m.attachments, aid)
+		}
+	}
+}
+
+func (m *MemStorage) PurgeTrash(age time.Duration) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	cutoff := time.Now().Add(-age)
+	for id, dtime := range m.trash {
+		if !dtime.ToTime().After(cutoff) {
+			m.purgeNote(id)
+			n += 1
+		}
+	}
+	return n, nil
+}
+
+func (m *MemStorage) PurgeExpiredTrash() (int, error) {
+	days, _ := m.TrashRetention()
+	if days < 1 {
+		return 0, nil
+	}
+	return m.PurgeTrash(time.Duration(days) * 24 * time.Hour)
+}
+
+func (m *MemStorage) Editor() (string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.editor, nil
+}
+
+func (m *MemStorage) SetEditor(editor string) error {
+	editor, err := checkEditor(editor)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.editor = editor
+	return nil
+}
+
+func (m *MemStorage) TrashRetention() (int, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.trashDays, nil
+}
+
+func (m *MemStorage) SetTrashRetention(days int) error {
+	if days < 0 {
+		return errors.New("number of days must not be negative")
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.trashDays = days
+	return nil
+}
+
+func (m *MemStorage) ListNotebooks() ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	seen := map[string]struct{}{}
+	notebooks := []string{}
+	for _, n := range m.notes {
+		if _, ok := seen[n.Notebook]; ok || n.Notebook == "" {
+			continue
+		}
+		if _, ok := m.trash[n.Id]; ok {
+			continue
+		}
+		seen[n.Notebook] = struct{}{}
+		notebooks = append(notebooks, n.Notebook)
+	}
+	sort.Strings(notebooks)
+	return notebooks, nil
+}
+
+func (m *MemStorage) MoveNote(id int, notebook string) error {
+	m.Lock()
+	defer m.Unlock()
+	n, ok := m.notes[id]
+	if !ok {
+		return ErrNoteNotFound
+	}
+	if _, ok := m.trash[id]; ok {
+		return ErrNoteInTrash
+	}
+	n.Notebook = NormalizeNotebook(notebook)
+	m.notes[id] = n
+	return nil
+}
+
+func (m *MemStorage) FetchAttachments(noteId int) ([]Attachment, error) {
+	m.RLock()
+	defer m.RUnlock()
+	atts := []Attachment{}
+	for _, a := range m.attachments {
+		if a.NoteId == noteId {
+			a.Data = nil
+			atts = append(atts, a)
+		}
+	}
+	sort.Slice(atts, func(i, j int) bool { return atts[i].Id < atts[j].Id })
+	return atts, nil
+}
+
+func (m *MemStorage) FetchAttachment(id int) (Attachment, error) {
+	m.RLock()
+	defer m.RUnlock()
+	a, ok := m.attachments[id]
+	if !ok {
+		return Attachment{}, ErrAttachmentNotFound
+	}
+	return a, nil
+}
+
+func (m *MemStorage) AddAttachment(noteId int, name string, data []byte) (Attachment, error) {
+	if len(data) > MaxAttachmentSize {
+		return Attachment{}, fmt.Errorf("attachment is too large, max size: %v bytes", MaxAttachmentSize)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.notes[noteId]; !ok {
+		return Attachment{}, ErrNoteNotFound
+	}
+	a := Attachment{Id: m.nextAttId, NoteId: noteId, Name: name, Size: int64(len(data)), Ctime: Now(),
+		Data: append([]byte{}, data...)}
+	m.nextAttId += 1
+	m.attachments[a.Id] = a
+	a.Data = nil
+	return a, nil
+}
+
+func (m *MemStorage) DeleteAttachment(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.attachments[id]; !ok {
+		return ErrAttachmentNotFound
+	}
+	delete(m.attachments, id)
+	return nil
+}
+
+func (m *MemStorage) SetMetaEncryption(enabled bool) error {
+	m.Lock()
+	defer m.Unlock()
+	m.encryptMeta = enabled
+	return nil
+}
+
+func (m *MemStorage) MetaEncrypted() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.encryptMeta
+}
+
+func (m *MemStorage) BackupFiles() ([]string, error) {
+	return nil, nil
+}
+
+func (m *MemStorage) MergeDB(file string, pw string) (MergeResult, error) {
+	return MergeResult{}, errors.New("merging database is not supported by in-memory storage")
+}
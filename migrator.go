@@ -1,5 +1,535 @@
 package main
 
-func MergeDB(file string) {
-	// TODO: impl this
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"gorm.io/gorm"
+)
+
+const (
+	CKeySchemaVersion = "SchemaVersion"
+
+	// version of the schema created by InitSchema, vaults without CKeySchemaVersion are also at this version
+	BaseSchemaVersion = "v0.0.0"
+
+	// since this version, encrypted values are bound to their rows, see SealBound
+	BoundSchemaVersion = "v0.7.0"
+)
+
+type Migration struct {
+	Version string // schema version after the migration
+	Desc    string
+	Run     func(tx *gorm.DB) error
+}
+
+// Ordered schema migrations, version of the last one must be SchemaVersion.
+//
+// Each migration runs in its own transaction together with the update of CKeySchemaVersion,
+// the vault key is already initialized when migrations run, so notes can be re-encrypted if necessary.
+var migrations = []Migration{
+	{Version: "v0.1.0", Desc: "create tag tables", Run: createTagTables},
+	{Version: "v0.2.0", Desc: "create notebook table", Run: createNotebookTable},
+	{Version: "v0.3.0", Desc: "create revision table", Run: createRevisionTable},
+	{Version: "v0.4.0", Desc: "create trash table", Run: createTrashTable},
+	{Version: "v0.5.0", Desc: "create attachment table", Run: createAttachmentTable},
+	{Version: "v0.6.0", Desc: "create field table", Run: createFieldTable},
+	{Version: BoundSchemaVersion, Desc: "bind ciphertext to rows", Run: bindCiphertext},
+	{Version: "v0.8.0", Desc: "add fields to revisions", Run: addRevisionFields},
+}
+
+// Load schema version stored in pocket_config.
+func LoadSchemaVersion(db *gorm.DB) (string, error) {
+	v, ok, err := GetConfig(db, CKeySchemaVersion)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return BaseSchemaVersion, nil
+	}
+	return v, nil
+}
+
+// Check whether the vault can be opened by this binary, vaults created by newer versions are refused.
+func CheckSchemaVersion(db *gorm.DB) error {
+	v, err := LoadSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	c, err := CompareVersion(v, SchemaVersion)
+	if err != nil {
+		return fmt.Errorf("invalid schema version, database may be corrupted, %v", err)
+	}
+	if c > 0 {
+		return fmt.Errorf("vault schema %v is newer than the supported schema %v, please upgrade pocket", v, SchemaVersion)
+	}
+	return nil
+}
+
+// Apply the pending migrations, the database file is backed up before migrating unless file is empty.
+func MigrateSchema(db *gorm.DB, file string) error {
+	return migrateSchema(db, file, migrations)
+}
+
+func migrateSchema(db *gorm.DB, file string, steps []Migration) error {
+	current, err := LoadSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	pending := []Migration{}
+	for _, m := range steps {
+		c, err := CompareVersion(m.Version, current)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) < 1 {
+		return nil
+	}
+
+	if file != "" {
+		bak, err := BackupDB(db, file, current)
+		if err != nil {
+			return err
+		}
+		Debugf("Backed up database to %v before migrating schema from %v", bak, current)
+	}
+
+	for _, m := range pending {
+		Debugf("Migrating schema to %v, %v", m.Version, m.Desc)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Run(tx); err != nil {
+				return err
+			}
+			return SetConfig(tx, CKeySchemaVersion, m.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate schema to %v (%v), %v", m.Version, m.Desc, err)
+		}
+	}
+	return nil
+}
+
+// Backup database to '<file>.<schema version>.<time>.bak' using VACUUM INTO, returns path to the backup file.
+func BackupDB(db *gorm.DB, file string, version string) (string, error) {
+	bak := fmt.Sprintf("%v.%v.%v.bak", file, version, time.Now().Format("20060102150405"))
+	if _, err := os.Stat(bak); err == nil {
+		return "", fmt.Errorf("backup file %v already exists", bak)
+	}
+	if err := db.Exec(`VACUUM INTO ?`, bak).Error; err != nil {
+		return "", fmt.Errorf("failed to backup database to %v, %v", bak, err)
+	}
+	if err := os.Chmod(bak, 0600); err != nil {
+		return "", fmt.Errorf("failed to chmod backup file %v, %v", bak, err)
+	}
+	return bak, nil
+}
+
+func (s *SqliteStorage) BackupFiles() ([]string, error) {
+	baks, err := filepath.Glob(s.file + ".*.bak")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find backup files, %v", err)
+	}
+	return baks, nil
+}
+
+// Compare versions in format 'vX.Y.Z'.
+func CompareVersion(a string, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] > vb[i] {
+				return 1, nil
+			}
+			return -1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parseVersion(v string) ([3]int, error) {
+	var r [3]int
+	tokens := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(tokens) != 3 {
+		return r, fmt.Errorf("malformed version '%v'", v)
+	}
+	for i, t := range tokens {
+		n, err := cast.ToIntE(t)
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("malformed version '%v'", v)
+		}
+		r[i] = n
+	}
+	return r, nil
+}
+
+type MergeResult struct {
+	Added       []Note // notes imported into current vault
+	Skipped     []Note // duplicates, notes that are already present in current vault
+	Conflicts   []Note // notes with same name and ctime but different desc or content, these are not imported
+	Revisions   int    // number of revisions imported together with the added notes
+	Attachments int    // number of attachments imported together with the added notes
+}
+
+func (m MergeResult) String() string {
+	return fmt.Sprintf("Added: %d (revisions: %d, attachments: %d), Skipped: %d, Conflicts: %d", len(m.Added), m.Revisions,
+		m.Attachments, len(m.Skipped), len(m.Conflicts))
+}
+
+// Merge notes from another pocket database into current vault.
+//
+// The other vault is unlocked using pw, and it's never modified. Notes with the same name and ctime, or with
+// the same name, desc and content are treated as duplicates. Imported notes, together with their revisions and
+// attachments, are re-encrypted with current vault key in a single transaction.
+func (s *SqliteStorage) MergeDB(file string, pw string) (MergeResult, error) {
+	if _, err := os.Stat(file); err != nil {
+		return MergeResult{}, fmt.Errorf("failed to open SQLite file, %v", err)
+	}
+	if same, err := isSameFile(file, s.file); err != nil {
+		return MergeResult{}, err
+	} else if same {
+		return MergeResult{}, errors.New("can't merge the vault into itself")
+	}
+
+	other, err := OpenReadOnlyDB(file)
+	if err != nil {
+		return MergeResult{}, fmt.Errorf("failed to open SQLite file, file: %v, %v", file, err)
+	}
+	defer func() {
+		if sq, err := other.DB(); err == nil {
+			sq.Close()
+		}
+	}()
+
+	ov, err := openOtherVault(other, pw)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer ov.close()
+	incoming, err := ov.loadNotes()
+	if err != nil {
+		return MergeResult{}, err
+	}
+	existing, err := s.loadAllNotes()
+	if err != nil {
+		return MergeResult{}, err
+	}
+
+	byNameCtime := map[string]Note{}
+	byHash := map[[32]byte]struct{}{}
+	for _, n := range existing {
+		byNameCtime[noteNameCtimeKey(n)] = n
+		byHash[noteHash(n)] = struct{}{}
+	}
+
+	res := MergeResult{}
+	toAdd := []Note{}
+	for _, n := range incoming {
+		if _, ok := byHash[noteHash(n)]; ok {
+			res.Skipped = append(res.Skipped, n)
+			continue
+		}
+		if _, ok := byNameCtime[noteNameCtimeKey(n)]; ok {
+			res.Conflicts = append(res.Conflicts, n)
+			continue
+		}
+		toAdd = append(toAdd, n)
+		byHash[noteHash(n)] = struct{}{}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, n := range toAdd {
+			otherId := n.Id
+			n, err := s.createNote(tx, n)
+			if err != nil {
+				return fmt.Errorf("failed to import note %v, %v", otherId, err)
+			}
+			res.Added = append(res.Added, n)
+
+			revs, err := ov.loadRevisions(otherId)
+			if err != nil {
+				return err
+			}
+			for _, r := range revs {
+				r.NoteId = n.Id
+				if err := insertRevision(tx, r); err != nil {
+					return fmt.Errorf("failed to import revision %v of note %v, %v", r.Id, otherId, err)
+				}
+			}
+			res.Revisions += len(revs)
+
+			ids, err := ov.attachmentIds(otherId)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				a, err := ov.loadAttachment(id)
+				if err != nil {
+					return err
+				}
+				a.NoteId = n.Id
+				if _, err := insertAttachment(tx, a); err != nil {
+					return fmt.Errorf("failed to import attachment %v of note %v, %v", id, otherId, err)
+				}
+			}
+			res.Attachments += len(ids)
+		}
+		return nil
+	})
+	if err != nil {
+		return MergeResult{}, err
+	}
+
+	if s.encryptMeta {
+		for _, n := range res.Added {
+			s.metaIndex.Put(n)
+		}
+	}
+	Debugf("Merged %v, %v", file, res)
+	return res, nil
+}
+
+// The other vault that is merged into current vault, it's unlocked with its own key, see MergeDB.
+type otherVault struct {
+	db    *gorm.DB
+	key   []byte
+	meta  bool // whether note name and desc are encrypted
+	bound bool // whether values are bound to their rows, vaults before BoundSchemaVersion are not
+}
+
+// Unlock the other vault, close should be called to wipe its key.
+func openOtherVault(db *gorm.DB, pw string) (*otherVault, error) {
+	exists, err := vaultExists(db)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("the other database is not a pocket vault")
+	}
+	if err := CheckSchemaVersion(db); err != nil {
+		return nil, err
+	}
+	key, _, err := FindVaultKey(db, pw, "")
+	if err != nil {
+		if errors.Is(err, ErrKeyFileRequired) {
+			return nil, errors.New("the other vault requires key file, it can't be merged")
+		}
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("password of the other vault is incorrect")
+	}
+	o := &otherVault{db: db, key: key}
+	if o.meta, err = isMetaEncrypted(db); err != nil {
+		o.close()
+		return nil, err
+	}
+	v, err := LoadSchemaVersion(db)
+	if err != nil {
+		o.close()
+		return nil, err
+	}
+	c, err := CompareVersion(v, BoundSchemaVersion)
+	if err != nil {
+		o.close()
+		return nil, fmt.Errorf("invalid schema version, database may be corrupted, %v", err)
+	}
+	o.bound = c >= 0
+	return o, nil
+}
+
+func (o *otherVault) close() {
+	wipeBytes(o.key)
+}
+
+func (o *otherVault) decrypt(s string, ad string) (string, error) {
+	if !o.bound {
+		return DecryptWith(o.key, s)
+	}
+	return DecryptBoundWith(o.key, s, ad)
+}
+
+func (o *otherVault) open(dec []byte, ad string) ([]byte, error) {
+	if !o.bound {
+		return Open(o.key, dec)
+	}
+	return OpenBound(o.key, dec, ad)
+}
+
+// Load all notes of the other vault in plaintext.
+func (o *otherVault) loadNotes() ([]Note, error) {
+	db := o.db
+
+	// notes in trash of the other vault are not merged
+	t := db.Table("pocket_note").Select("rowid id, name, desc, content, ctime, utime")
+	if ok, err := tableExists(db, "pocket_note_trash"); err != nil {
+		return nil, err
+	} else if ok {
+		t = t.Where(notTrashedSql)
+	}
+	var notes []Note
+	if err := t.Scan(&notes).Error; err != nil {
+		return nil, fmt.Errorf("failed to query notes, %v", err)
+	}
+	var err error
+	for i, n := range notes {
+		if n.Content, err = o.decrypt(n.Content, noteAD(n.Id, "content")); err != nil {
+			return nil, fmt.Errorf("failed to decrypt note %v of the other vault, %v", n.Id, err)
+		}
+		if o.meta {
+			if n.Name, n.Desc, err = decryptPair(o.decrypt, n.Name, noteAD(n.Id, "name"), n.Desc, noteAD(n.Id, "desc")); err != nil {
+				return nil, fmt.Errorf("failed to decrypt note %v of the other vault, %v", n.Id, err)
+			}
+		}
+		notes[i] = n
+	}
+
+	// vaults of older schema version may not have tags, notebooks or fields
+	if ok, err := tableExists(db, "pocket_note_tag"); err != nil {
+		return nil, err
+	} else if ok {
+		if err := loadNoteTags(db, notes); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := tableExists(db, "pocket_note_notebook"); err != nil {
+		return nil, err
+	} else if ok {
+		if err := loadNoteNotebooks(db, notes); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := tableExists(db, "pocket_note_field"); err != nil {
+		return nil, err
+	} else if ok {
+		if err := loadNoteFields(db, o.decrypt, notes); err != nil {
+			return nil, err
+		}
+	}
+	return notes, nil
+}
+
+// Load revisions of the note in the other vault, oldest revision first.
+func (o *otherVault) loadRevisions(noteId int) ([]Revision, error) {
+	if ok, err := tableExists(o.db, "pocket_note_revision"); err != nil || !ok {
+		return nil, err
+	}
+	fields := "''"
+	if ok, err := columnExists(o.db, "pocket_note_revision", "fields"); err != nil {
+		return nil, err
+	} else if ok {
+		fields = "fields"
+	}
+	var rows []revisionRow
+	err := o.db.Raw(`SELECT id, note_id, name, desc, content, `+fields+` enc_fields, utime, rtime FROM pocket_note_revision
+		WHERE note_id = ? ORDER BY id`, noteId).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_note_revision of the other vault, %v", err)
+	}
+	revs := make([]Revision, 0, len(rows))
+	for _, row := range rows {
+		r, err := decryptRevision(o.decrypt, row)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, r)
+	}
+	return revs, nil
+}
+
+// Ids of the attachments of the note in the other vault, attachments are loaded one by one as they can be large.
+func (o *otherVault) attachmentIds(noteId int) ([]int, error) {
+	if ok, err := tableExists(o.db, "pocket_attachment"); err != nil || !ok {
+		return nil, err
+	}
+	var ids []int
+	if err := o.db.Raw(`SELECT id FROM pocket_attachment WHERE note_id = ? ORDER BY id`, noteId).Scan(&ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to query pocket_attachment of the other vault, %v", err)
+	}
+	return ids, nil
+}
+
+// Load attachment of the other vault with decrypted data.
+func (o *otherVault) loadAttachment(id int) (Attachment, error) {
+	var atts []Attachment
+	err := o.db.Raw(`SELECT id, note_id, name, size, data, ctime FROM pocket_attachment WHERE id = ?`, id).
+		Scan(&atts).Error
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to query pocket_attachment of the other vault, %v", err)
+	}
+	if len(atts) < 1 {
+		return Attachment{}, ErrAttachmentNotFound
+	}
+	a := atts[0]
+	if a.Name, err = o.decrypt(a.Name, attachmentAD(a.NoteId, a.Id, "name")); err != nil {
+		return Attachment{}, fmt.Errorf("failed to decrypt attachment %v of the other vault, %v", a.Id, err)
+	}
+	if a.Data, err = o.open(a.Data, attachmentAD(a.NoteId, a.Id, "data")); err != nil {
+		return Attachment{}, fmt.Errorf("failed to decrypt attachment %v of the other vault, %v", a.Id, err)
+	}
+	return a, nil
+}
+
+func (s *SqliteStorage) loadAllNotes() ([]Note, error) {
+	var notes []Note
+	if err := s.db.Raw(`SELECT rowid id, name, desc, content, ctime, utime FROM pocket_note`).Scan(&notes).Error; err != nil {
+		return nil, fmt.Errorf("failed to query notes, %v", err)
+	}
+	for i := range notes {
+		n, err := s.DecryptNote(notes[i])
+		if err != nil {
+			return nil, err
+		}
+		notes[i] = n
+	}
+	if err := loadNoteFields(s.db, DecryptBound, notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func noteNameCtimeKey(n Note) string {
+	return n.Name + "\x00" + n.Ctime.FormatClassic()
+}
+
+func noteHash(n Note) [32]byte {
+	h := sha256.New()
+	h.Write([]byte(n.Name + "\x00" + n.Desc + "\x00" + n.Content))
+	for _, f := range n.Fields {
+		h.Write([]byte(fmt.Sprintf("\x00%v\x00%v\x00%v\x00%v", f.Name, f.Type, f.Value, f.Secret)))
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Check whether a and b are the same file, links to the same file are the same file as well.
+func isSameFile(a string, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
 }
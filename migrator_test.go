@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		a string
+		b string
+		c int
+	}{
+		{"v0.0.0", "v0.0.0", 0},
+		{"v0.0.1", "v0.0.0", 1},
+		{"v0.2.0", "v0.10.0", -1},
+		{"v1.0.0", "v0.99.99", 1},
+	}
+	for _, c := range cases {
+		r, err := CompareVersion(c.a, c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != c.c {
+			t.Fatalf("compare %v %v, expected: %v, actual: %v", c.a, c.b, c.c, r)
+		}
+	}
+	if _, err := CompareVersion("v0.1", "v0.0.0"); err == nil {
+		t.Fatal("should fail to parse malformed version")
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	_kdfMemory = 64
+	defer func() { _kdfMemory = DefaultKdfMemory }()
+
+	file := filepath.Join(t.TempDir(), "pocket.db")
+	db, err := OpenDB(file, false, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewSqliteStorage(db, file)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	// new vault is already at SchemaVersion, pretend it's at the base version
+	if err := SetConfig(db, CKeySchemaVersion, BaseSchemaVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []Migration{
+		{Version: "v0.0.1", Desc: "create tb1", Run: func(tx *gorm.DB) error {
+			return tx.Exec(`CREATE TABLE tb1 (id INTEGER)`).Error
+		}},
+		{Version: "v0.0.2", Desc: "create tb2 and fail", Run: func(tx *gorm.DB) error {
+			if err := tx.Exec(`CREATE TABLE tb2 (id INTEGER)`).Error; err != nil {
+				return err
+			}
+			return errors.New("something is wrong")
+		}},
+	}
+	if err := migrateSchema(db, file, steps); err == nil {
+		t.Fatal("migration should fail")
+	}
+
+	v, err := LoadSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "v0.0.1" {
+		t.Fatalf("schema version should be v0.0.1, actual: %v", v)
+	}
+	var tables []string
+	if err := db.Raw(`SELECT name FROM sqlite_master WHERE type = 'table' AND name IN ('tb1', 'tb2')`).Scan(&tables).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0] != "tb1" {
+		t.Fatalf("failed migration is not rolled back, %v", tables)
+	}
+
+	baks, _ := filepath.Glob(file + "." + BaseSchemaVersion + ".*.bak")
+	if len(baks) != 1 {
+		t.Fatalf("database is not backed up, %v", baks)
+	}
+
+	if err := SetConfig(db, CKeySchemaVersion, "v999.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchemaVersion(db); err == nil {
+		t.Fatal("should refuse vault newer than the binary")
+	}
+}
+
+func TestBindCiphertext(t *testing.T) {
+	st := newTestSqliteStorage(t)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetMetaEncryption(true); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	for _, n := range []Note{
+		{Name: "aws", Content: "secret", Fields: []NoteField{{Name: "password", Type: FieldPassword, Value: "pw"}}, Ctime: now, Utime: now},
+		{Name: "gcp", Content: "secret2", Ctime: now, Utime: now},
+	} {
+		if _, err := st.CreateNote(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := st.FetchNote(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Content = "secret2"
+	if err := st.UpdateNote(n); err != nil {
+		t.Fatal(err)
+	}
+
+	// values of the old versions are not bound to their rows
+	old := Encrypt0("old")
+	if err := st.db.Exec(`UPDATE pocket_note SET name = ?, desc = ?, content = ?`, old, old, old).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := st.db.Exec(`UPDATE pocket_note_field SET name = ?, value = ?`, old, old).Error; err != nil {
+		t.Fatal(err)
+	}
+	oldFields := Encrypt0(`[{"Name":"password","Type":"password","Value":"old"}]`)
+	err = st.db.Exec(`UPDATE pocket_note_revision SET name = ?, desc = ?, content = ?, fields = ?`, old, old, old, oldFields).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.db.Transaction(bindCiphertext); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = st.FetchNote(1); err != nil {
+		t.Fatal(err)
+	}
+	if n.Name != "old" || n.Content != "old" || len(n.Fields) != 1 || n.Fields[0].Value != "old" {
+		t.Fatalf("values are not bound, %+v", n)
+	}
+	revs, err := st.FetchRevisions(1)
+	if err != nil || len(revs) != 1 || revs[0].Content != "old" || len(revs[0].Fields) != 1 || revs[0].Fields[0].Value != "old" {
+		t.Fatalf("revisions are not bound, %+v, %v", revs, err)
+	}
+	var fields string
+	if err := st.db.Raw(`SELECT fields FROM pocket_note_revision WHERE id = ?`, revs[0].Id).Scan(&fields).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptBound(fields, revisionAD(1, revs[0].Id, "fields")); err != nil {
+		t.Fatalf("fields of revision are not bound, %v", err)
+	}
+
+	// nothing is saved if the note can't be encrypted
+	st.LockVault()
+	n.Content = "new"
+	if err := st.UpdateNote(n); err == nil {
+		t.Fatal("note shouldn't be updated when vault is locked")
+	}
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n, err = st.FetchNote(1); err != nil || n.Content != "old" {
+		t.Fatalf("note shouldn't be changed, %+v, %v", n, err)
+	}
+
+	// bound value can't be moved to other rows
+	err = st.db.Exec(`UPDATE pocket_note SET content = (SELECT content FROM pocket_note WHERE rowid = 1) WHERE rowid = 2`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.FetchNote(2); !errors.Is(err, ErrTampered) {
+		t.Fatalf("content moved from other note shouldn't be decrypted, %v", err)
+	}
+	if _, _, err := st.FetchNotes(NoteQuery{Page: 1, Limit: 5}); !errors.Is(err, ErrTampered) {
+		t.Fatalf("content moved from other note shouldn't be decrypted, %v", err)
+	}
+
+	// type and secret flag of field are stored in plaintext, but they are authenticated as well
+	if err := st.db.Exec(`UPDATE pocket_note_field SET secret = NOT secret WHERE note_id = 1`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.FetchNote(1); !errors.Is(err, ErrTampered) {
+		t.Fatalf("field with secret flag changed in database shouldn't be decrypted, %v", err)
+	}
+}
+
+func TestMergeDB(t *testing.T) {
+	other := newTestSqliteStorage(t)
+	if ok, err := other.CheckPassword("otherpassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := other.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	now := Now()
+	n, err := other.CreateNote(Note{Name: "aws", Content: "v1", Ctime: now, Utime: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Content = "v2"
+	if err := other.UpdateNote(n); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.AddAttachment(n.Id, "id_rsa", []byte("private key")); err != nil {
+		t.Fatal(err)
+	}
+	other.LockVault()
+
+	st := newTestSqliteStorage(t)
+	if ok, err := st.CheckPassword("mypassword"); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if err := st.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateNote(Note{Name: "gcp", Content: "secret", Ctime: now, Utime: now}); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if _, err := st.MergeDB(missing, "otherpassword"); err == nil {
+		t.Fatal("should fail to merge missing file")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("missing file should not be created, %v", err)
+	}
+	link := filepath.Join(t.TempDir(), "link.db")
+	if err := os.Symlink(st.file, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.MergeDB(link, "mypassword"); err == nil {
+		t.Fatal("should fail to merge the vault into itself")
+	}
+
+	res, err := st.MergeDB(other.file, "otherpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Added) != 1 || res.Revisions != 1 || res.Attachments != 1 {
+		t.Fatalf("unexpected result, %v", res)
+	}
+	id := res.Added[0].Id
+	if revs, err := st.FetchRevisions(id); err != nil || len(revs) != 1 || revs[0].Content != "v1" {
+		t.Fatalf("revisions are not merged, %+v, %v", revs, err)
+	}
+	atts, err := st.FetchAttachments(id)
+	if err != nil || len(atts) != 1 {
+		t.Fatalf("attachments are not merged, %+v, %v", atts, err)
+	}
+	if a, err := st.FetchAttachment(atts[0].Id); err != nil || a.Name != "id_rsa" || string(a.Data) != "private key" {
+		t.Fatalf("attachments are not merged, %+v, %v", a, err)
+	}
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	prev := BaseSchemaVersion
+	for _, m := range migrations {
+		if c, err := CompareVersion(m.Version, prev); err != nil || c <= 0 {
+			t.Fatalf("migration %v is not ordered, %v", m.Version, err)
+		}
+		prev = m.Version
+	}
+	if prev != SchemaVersion {
+		t.Fatalf("SchemaVersion %v doesn't match the last migration %v", SchemaVersion, prev)
+	}
+}
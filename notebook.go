@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	NotebookSep = "/"
+
+	// notes in the notebook or any of its descendants, '0' is the next character of '/', the unary '+' stops SQLite
+	// from using rowid lookup on the FTS table (see tagFilterSql)
+	notebookFilterSql = `+rowid IN (
+		SELECT note_id FROM pocket_note_notebook
+		WHERE notebook = ? OR (notebook >= ? AND notebook < ?)
+	)`
+)
+
+// Normalize notebook path, e.g., ' infra//prod/ ' is normalized to 'infra/prod', empty string is the root notebook.
+func NormalizeNotebook(s string) string {
+	segs := []string{}
+	for _, seg := range strings.Split(s, NotebookSep) {
+		seg = strings.TrimSpace(seg)
+		if seg == "" || seg == "." {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return strings.Join(segs, NotebookSep)
+}
+
+// Whether notebook is the same as parent or is one of its descendants.
+func InNotebook(notebook string, parent string) bool {
+	return parent == "" || notebook == parent || strings.HasPrefix(notebook, parent+NotebookSep)
+}
+
+// Parent of the notebook, parent of top-level notebooks is the root notebook.
+func ParentNotebook(notebook string) string {
+	if i := strings.LastIndex(notebook, NotebookSep); i > -1 {
+		return notebook[:i]
+	}
+	return ""
+}
+
+// Expand notebooks with all their ancestors, e.g., ['infra/prod'] is expanded to ['infra', 'infra/prod'].
+func ExpandNotebooks(notebooks []string) []string {
+	seen := map[string]struct{}{}
+	for _, nb := range notebooks {
+		for nb != "" {
+			seen[nb] = struct{}{}
+			nb = ParentNotebook(nb)
+		}
+	}
+	expanded := make([]string, 0, len(seen))
+	for nb := range seen {
+		expanded = append(expanded, nb)
+	}
+	sort.Strings(expanded)
+	return expanded
+}
+
+// Notebook of each note is stored in pocket_note_notebook, notes without a record are in the root notebook.
+//
+// Notebook paths are not encrypted even if the note name and desc are encrypted.
+func createNotebookTable(tx *gorm.DB) error {
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_note_notebook (
+			note_id INTEGER PRIMARY KEY,
+			notebook TEXT NOT NULL
+		)
+	`).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE INDEX IF NOT EXISTS note_notebook_idx ON pocket_note_notebook (notebook)`).Error
+}
+
+func notebookFilterArgs(notebook string) []any {
+	return []any{notebook, notebook + NotebookSep, notebook + "0"}
+}
+
+func setNoteNotebook(tx *gorm.DB, noteId int, notebook string) error {
+	if err := tx.Exec(`DELETE FROM pocket_note_notebook WHERE note_id = ?`, noteId).Error; err != nil {
+		return fmt.Errorf("failed to update pocket_note_notebook, %v", err)
+	}
+	if notebook == "" {
+		return nil
+	}
+	err := tx.Exec(`INSERT INTO pocket_note_notebook (note_id, notebook) VALUES (?,?)`, noteId, notebook).Error
+	if err != nil {
+		return fmt.Errorf("failed to save pocket_note_notebook, %v", err)
+	}
+	return nil
+}
+
+// Load notebooks of the notes.
+func loadNoteNotebooks(db *gorm.DB, notes []Note) error {
+	if len(notes) < 1 {
+		return nil
+	}
+	ids := make([]int, 0, len(notes))
+	for _, n := range notes {
+		ids = append(ids, n.Id)
+	}
+
+	var rows []struct {
+		NoteId   int
+		Notebook string
+	}
+	err := db.Raw(`SELECT note_id, notebook FROM pocket_note_notebook WHERE note_id IN ?`, ids).Scan(&rows).Error
+	if err != nil {
+		return fmt.Errorf("failed to query note notebooks, %v", err)
+	}
+
+	byNote := map[int]string{}
+	for _, r := range rows {
+		byNote[r.NoteId] = r.Notebook
+	}
+	for i := range notes {
+		notes[i].Notebook = byNote[notes[i].Id]
+	}
+	return nil
+}
+
+// Find ids of notes in the notebook or any of its descendants.
+func findNoteIdsByNotebook(db *gorm.DB, notebook string) (map[int]struct{}, error) {
+	var ids []int
+	err := db.Table("pocket_note").
+		Select("rowid").
+		Where(notebookFilterSql, notebookFilterArgs(notebook)...).
+		Scan(&ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes by notebook, %v", err)
+	}
+	set := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set, nil
+}
+
+// List notebooks that contain at least one note (not in trash), ancestors are not included.
+func (s *SqliteStorage) ListNotebooks() ([]string, error) {
+	var notebooks []string
+	err := s.db.Raw(`
+		SELECT DISTINCT notebook FROM pocket_note_notebook
+		WHERE note_id NOT IN (SELECT note_id FROM pocket_note_trash)
+		ORDER BY notebook
+	`).Scan(&notebooks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_note_notebook, %v", err)
+	}
+	return notebooks, nil
+}
+
+// Move note to another notebook, the note's update time is not changed.
+func (s *SqliteStorage) MoveNote(id int, notebook string) error {
+	if _, err := s.FetchNote(id); err != nil {
+		return err
+	}
+	return setNoteNotebook(s.db, id, NormalizeNotebook(notebook))
+}
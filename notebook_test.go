@@ -0,0 +1,20 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotebook(t *testing.T) {
+	if nb := NormalizeNotebook(" /infra// prod /./db/ "); nb != "infra/prod/db" {
+		t.Fatalf("unexpected notebook, %q", nb)
+	}
+	if !InNotebook("infra/prod", "infra") || !InNotebook("infra", "") || InNotebook("infra2", "infra") {
+		t.Fatal("unexpected InNotebook result")
+	}
+	expanded := ExpandNotebooks([]string{"infra/prod/db", "dev", "infra/staging"})
+	expected := []string{"dev", "infra", "infra/prod", "infra/prod/db", "infra/staging"}
+	if !reflect.DeepEqual(expanded, expected) {
+		t.Fatalf("unexpected notebooks, %v", expanded)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CKeyRecoverySlot = "KeySlot:recovery:" // followed by the number of the code, e.g., 'KeySlot:recovery:3'
+
+	RecoveryCodeCount = 8
+
+	recoveryCodeLen   = 20 // 100 bits
+	recoveryCodeGroup = 5
+	recoveryChars     = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+)
+
+var ErrRecoveryCodeWrong = errors.New("recovery code is incorrect or already used")
+
+// Generate random recovery code, e.g., 'K7R2M-XQ9TB-4HNWE-PZ3AC'.
+func newRecoveryCode() string {
+	s := doRand(recoveryCodeLen, []rune(recoveryChars))
+	groups := make([]string, 0, recoveryCodeLen/recoveryCodeGroup)
+	for i := 0; i < len(s); i += recoveryCodeGroup {
+		groups = append(groups, s[i:i+recoveryCodeGroup])
+	}
+	return strings.Join(groups, "-")
+}
+
+// Recovery code typed by user is case insensitive, dashes and spaces are ignored.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+type recoverySlot struct {
+	ConfigKey   string
+	ConfigValue string
+}
+
+func loadRecoverySlots(db *gorm.DB) ([]recoverySlot, error) {
+	var slots []recoverySlot
+	err := db.Raw(`SELECT config_key, config_value FROM pocket_config WHERE config_key LIKE ? ORDER BY config_key`, CKeyRecoverySlot+"%").
+		Scan(&slots).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_config, %v", err)
+	}
+	return slots, nil
+}
+
+// Replace recovery codes of the unlocked vault, each code wraps the vault data key in its own key slot.
+func (s *SqliteStorage) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	slots := make([]KeySlot, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := newRecoveryCode()
+		slot, err := newVaultKeySlot(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		slots = append(slots, slot)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DELETE FROM pocket_config WHERE config_key LIKE ?`, CKeyRecoverySlot+"%").Error; err != nil {
+			return err
+		}
+		for i, slot := range slots {
+			if err := SetConfig(tx, fmt.Sprintf("%v%d", CKeyRecoverySlot, i+1), slot.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save recovery codes, %v", err)
+	}
+	return codes, nil
+}
+
+// Unlock the vault with the recovery code and set the new password, the code can't be used again.
+//
+// The new password is combined with the key file specified by -keyfile (if any), the key file that the vault
+// required before is no longer needed. Returns the number of recovery codes left.
+func (s *SqliteStorage) RecoverPassword(code string, newPw string) (int, error) {
+	exists, err := vaultExists(s.db)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errors.New("vault is not initialized yet")
+	}
+	if err := CheckSchemaVersion(s.db); err != nil {
+		return 0, err
+	}
+
+	slots, err := loadRecoverySlots(s.db)
+	if err != nil {
+		return 0, err
+	}
+	var dataKey []byte
+	var used string
+	code = normalizeRecoveryCode(code)
+	for _, r := range slots {
+		slot, err := ParseKeySlot(r.ConfigValue)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %v, database may be corrupted, %v", r.ConfigKey, err)
+		}
+		if key, ok := slot.Unlock(code); ok {
+			dataKey, used = key, r.ConfigKey
+			break
+		}
+	}
+	if dataKey == nil {
+		return 0, ErrRecoveryCodeWrong
+	}
+	if ok, err := checkKey(s.db, dataKey); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, errors.New("data key doesn't match the vault, database may be corrupted")
+	}
+
+	keyFile, err := ReadKeyFile(_keyFile)
+	if err != nil {
+		return 0, err
+	}
+	slot, err := NewKeySlot(keyFileSecret(newPw, keyFile), dataKey)
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := SetConfig(tx, CKeyPwSlot, slot.String()); err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM pocket_config WHERE config_key = ?`, used).Error; err != nil {
+			return err
+		}
+		if keyFile == nil {
+			return tx.Exec(`DELETE FROM pocket_config WHERE config_key = ?`, CKeyKeyFile).Error
+		}
+		return SetConfig(tx, CKeyKeyFile, keyFileCheck(keyFile))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset password, %v", err)
+	}
+	if err := s.unlockVault(dataKey); err != nil {
+		return 0, err
+	}
+	return len(slots) - 1, nil
+}
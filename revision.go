@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+)
+
+// Prior revision of a note, recorded before the note is updated.
+type Revision struct {
+	Id      int
+	NoteId  int
+	Name    string
+	Desc    string
+	Content string
+	Fields  []NoteField `gorm:"-"` // nil if the revision is recorded before fields are kept in revisions
+	Utime   ETime       // update time of the note at this revision
+	Rtime   ETime       // when the revision is recorded
+}
+
+type revisionRow struct {
+	Revision
+	EncFields string // encrypted JSON of the fields, empty if the fields are not recorded
+}
+
+// Name, desc and content of the revisions are always encrypted, they are never searched.
+//
+// Time columns of all tables are declared as TEXT, the SQLite driver returns zero time for DATETIME columns in
+// sqlTimeFormat.
+func createRevisionTable(tx *gorm.DB) error {
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_note_revision (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			note_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			desc TEXT NOT NULL,
+			content TEXT NOT NULL,
+			utime TEXT NOT NULL,
+			rtime TEXT NOT NULL
+		)
+	`).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE INDEX IF NOT EXISTS note_revision_note_idx ON pocket_note_revision (note_id)`).Error
+}
+
+// Fields of the revision are stored as encrypted JSON, it's empty for revisions recorded before this migration.
+func addRevisionFields(tx *gorm.DB) error {
+	if ok, err := columnExists(tx, "pocket_note_revision", "fields"); err != nil || ok {
+		return err
+	}
+	return tx.Exec(`ALTER TABLE pocket_note_revision ADD COLUMN fields TEXT NOT NULL DEFAULT ''`).Error
+}
+
+// Record current version of the note as a revision, nothing is recorded if the note is not changed.
+func (s *SqliteStorage) saveRevision(tx *gorm.DB, n Note) error {
+	var prev []Note
+	err := tx.Raw(`SELECT rowid id, name, desc, content, ctime, utime FROM pocket_note WHERE rowid = ?`, n.Id).
+		Scan(&prev).Error
+	if err != nil {
+		return fmt.Errorf("failed to query note, %v", err)
+	}
+	if len(prev) < 1 {
+		return ErrNoteNotFound
+	}
+	if prev[0], err = s.DecryptNote(prev[0]); err != nil {
+		return err
+	}
+	if err := loadNoteFields(tx, DecryptBound, prev); err != nil {
+		return err
+	}
+	p := prev[0]
+	if p.Name == n.Name && p.Desc == n.Desc && p.Content == n.Content && FieldsEqual(p.Fields, n.Fields) {
+		return nil
+	}
+	fields := p.Fields
+	if fields == nil {
+		fields = []NoteField{} // the note has no fields, which is different from fields not being recorded
+	}
+	return insertRevision(tx, Revision{NoteId: p.Id, Name: p.Name, Desc: p.Desc, Content: p.Content, Fields: fields,
+		Utime: p.Utime, Rtime: Now()})
+}
+
+// Save the revision, see rowAD.
+func insertRevision(tx *gorm.DB, r Revision) error {
+	err := tx.Exec(`INSERT INTO pocket_note_revision (note_id, name, desc, content, utime, rtime) VALUES (?,'','','',?,?)`,
+		r.NoteId, r.Utime, r.Rtime).Error
+	if err != nil {
+		return fmt.Errorf("failed to save pocket_note_revision, %v", err)
+	}
+	if err := tx.Raw(`SELECT last_insert_rowid()`).Scan(&r.Id).Error; err != nil {
+		return fmt.Errorf("failed to find id of newly saved revision, %v", err)
+	}
+
+	name, desc, err := encryptPair(r.Name, revisionAD(r.NoteId, r.Id, "name"), r.Desc, revisionAD(r.NoteId, r.Id, "desc"))
+	if err != nil {
+		return err
+	}
+	content, err := EncryptBound(r.Content, revisionAD(r.NoteId, r.Id, "content"))
+	if err != nil {
+		return err
+	}
+	fields := ""
+	if r.Fields != nil {
+		b, _ := json.Marshal(r.Fields)
+		if fields, err = EncryptBound(string(b), revisionAD(r.NoteId, r.Id, "fields")); err != nil {
+			return err
+		}
+	}
+	err = tx.Exec(`UPDATE pocket_note_revision SET name = ?, desc = ?, content = ?, fields = ? WHERE id = ?`, name, desc, content, fields, r.Id).Error
+	if err != nil {
+		return fmt.Errorf("failed to save pocket_note_revision, %v", err)
+	}
+	return nil
+}
+
+// Revision is bound to both the note and its own id, so it can't be moved to other notes or swapped.
+func revisionAD(noteId int, id int, column string) string {
+	return rowAD("pocket_note_revision", column, noteId, id)
+}
+
+// Fetch revisions of the note, latest revision first.
+func (s *SqliteStorage) FetchRevisions(noteId int) ([]Revision, error) {
+	var rows []revisionRow
+	err := s.db.Raw(`SELECT id, note_id, name, desc, content, fields enc_fields, utime, rtime FROM pocket_note_revision
+		WHERE note_id = ? ORDER BY id DESC`, noteId).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_note_revision, %v", err)
+	}
+	revs := make([]Revision, 0, len(rows))
+	for _, row := range rows {
+		r, err := decryptRevision(DecryptBound, row)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, r)
+	}
+	return revs, nil
+}
+
+func decryptRevision(decrypt decryptFunc, row revisionRow) (Revision, error) {
+	r := row.Revision
+	var err error
+	r.Name, r.Desc, err = decryptPair(decrypt, r.Name, revisionAD(r.NoteId, r.Id, "name"), r.Desc, revisionAD(r.NoteId, r.Id, "desc"))
+	if err != nil {
+		return Revision{}, fmt.Errorf("failed to decrypt revision %v, %v", r.Id, err)
+	}
+	if r.Content, err = decrypt(r.Content, revisionAD(r.NoteId, r.Id, "content")); err != nil {
+		return Revision{}, fmt.Errorf("failed to decrypt revision %v, %v", r.Id, err)
+	}
+	if row.EncFields != "" {
+		fields, err := decrypt(row.EncFields, revisionAD(r.NoteId, r.Id, "fields"))
+		if err != nil {
+			return Revision{}, fmt.Errorf("failed to decrypt revision %v, %v", r.Id, err)
+		}
+		r.Fields = []NoteField{}
+		if err := json.Unmarshal([]byte(fields), &r.Fields); err != nil {
+			return Revision{}, fmt.Errorf("failed to parse fields of revision %v, %v", r.Id, err)
+		}
+	}
+	return r, nil
+}
+
+// Restore the note to the revision, current version of the note is recorded as a new revision.
+func (s *SqliteStorage) RestoreRevision(noteId int, revId int) (Note, error) {
+	revs, err := s.FetchRevisions(noteId)
+	if err != nil {
+		return Note{}, err
+	}
+	n, err := s.FetchNote(noteId)
+	if err != nil {
+		return Note{}, err
+	}
+	for _, r := range revs {
+		if r.Id != revId {
+			continue
+		}
+		n.Name, n.Desc, n.Content, n.Utime = r.Name, r.Desc, r.Content, Now()
+		if r.Fields != nil {
+			n.Fields = r.Fields
+		}
+		if err := s.UpdateNote(n); err != nil {
+			return Note{}, err
+		}
+		return n, nil
+	}
+	return Note{}, ErrRevisionNotFound
+}
+
+func deleteRevisions(tx *gorm.DB, noteId int) error {
+	if err := tx.Exec(`DELETE FROM pocket_note_revision WHERE note_id = ?`, noteId).Error; err != nil {
+		return fmt.Errorf("failed to delete pocket_note_revision, %v", err)
+	}
+	return nil
+}
+
+// Bind all revisions to their rows, see bindCiphertext.
+func bindRevisions(tx *gorm.DB) error {
+	revs, err := loadRevisionRows(tx)
+	if err != nil {
+		return err
+	}
+	for _, r := range revs {
+		for _, c := range []struct {
+			v      *string
+			column string
+		}{{&r.Name, "name"}, {&r.Desc, "desc"}, {&r.Content, "content"}} {
+			if *c.v, err = rebind(*c.v, revisionAD(r.NoteId, r.Id, c.column)); err != nil {
+				return fmt.Errorf("failed to re-encrypt revision %v, %v", r.Id, err)
+			}
+		}
+		if r.EncFields != "" {
+			if r.EncFields, err = rebind(r.EncFields, revisionAD(r.NoteId, r.Id, "fields")); err != nil {
+				return fmt.Errorf("failed to re-encrypt revision %v, %v", r.Id, err)
+			}
+		}
+		if err := updateRevisionRow(tx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load encrypted revisions, fields are empty if the column is not added yet, see addRevisionFields.
+func loadRevisionRows(tx *gorm.DB) ([]revisionRow, error) {
+	fields := `''`
+	if ok, err := columnExists(tx, "pocket_note_revision", "fields"); err != nil {
+		return nil, err
+	} else if ok {
+		fields = "fields"
+	}
+	var revs []revisionRow
+	err := tx.Raw(`SELECT id, note_id, name, desc, content, ` + fields + ` enc_fields FROM pocket_note_revision`).Scan(&revs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pocket_note_revision, %v", err)
+	}
+	return revs, nil
+}
+
+func updateRevisionRow(tx *gorm.DB, r revisionRow) error {
+	err := tx.Exec(`UPDATE pocket_note_revision SET name = ?, desc = ?, content = ? WHERE id = ?`, r.Name, r.Desc, r.Content, r.Id).Error
+	if err == nil && r.EncFields != "" {
+		err = tx.Exec(`UPDATE pocket_note_revision SET fields = ? WHERE id = ?`, r.EncFields, r.Id).Error
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update pocket_note_revision, %v", err)
+	}
+	return nil
+}
+
+// Re-encrypt all revisions with the new key, see ReencryptVault.
+func reencryptRevisions(tx *gorm.DB, oldKey []byte, newKey []byte) error {
+	if ok, err := tableExists(tx, "pocket_note_revision"); err != nil || !ok {
+		return err
+	}
+	revs, err := loadRevisionRows(tx)
+	if err != nil {
+		return err
+	}
+	for _, r := range revs {
+		for _, v := range []*string{&r.Name, &r.Desc, &r.Content} {
+			if *v, err = reencrypt(oldKey, newKey, *v); err != nil {
+				return fmt.Errorf("failed to re-encrypt revision %v, %v", r.Id, err)
+			}
+		}
+		if r.EncFields != "" {
+			if r.EncFields, err = reencrypt(oldKey, newKey, r.EncFields); err != nil {
+				return fmt.Errorf("failed to re-encrypt revision %v, %v", r.Id, err)
+			}
+		}
+		if err := updateRevisionRow(tx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,54 +3,337 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	mr "math/rand"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	KdfArgon2id = "argon2id"
+
+	KeyLen     = 32
+	KdfSaltLen = 16
+
+	EnvelopeV1 = 1 // version of the envelope, see seal
+	EnvelopeV2 = 2 // envelope bound to associated data, see SealBound
+
+	// ids of the encryption algorithms in envelope
+	AlgAES256GCM         = 1
+	AlgXChaCha20Poly1305 = 2
+
+	keyIdLen          = 4
+	envelopeHeaderLen = 2 + keyIdLen // version, algorithm id and key id, followed by the nonce
+
+	DefaultKdfTime    = 3
+	DefaultKdfMemory  = 64 * 1024 // in KiB
+	DefaultKdfThreads = 4
+
+	// upper bounds of the kdf cost parameters, so that a tampered key slot can't make unlock run forever or
+	// allocate unlimited memory
+	MaxKdfTime   = 64
+	MaxKdfMemory = 4 * 1024 * 1024 // in KiB
+)
+
+var (
+	ErrKeyMismatch = errors.New("failed to decrypt, value is encrypted by another key")
+	ErrUnbound     = errors.New("failed to decrypt, value is not bound to its row, database may be tampered")
+	ErrTampered    = errors.New("failed to decrypt, value failed authentication, database may be tampered")
+	ErrVaultLocked = errors.New("vault is locked")
 )
 
 var (
 	digits           = []rune("0123456789")
-	_password []byte = nil
+	_password []byte = nil // slice of _keyPage while the vault is unlocked
+
+	_keyPage         []byte       // guarded memory that holds the key, see newGuardedPage
+	_restoreCoreDump func()       // core dumps are disabled while the vault is unlocked
+	_keyMu           sync.RWMutex // guards _password, held while the key is in use, see withKey
+
+	// cost parameters used when a new KdfParams is generated, existing vaults keep the ones stored in pocket_config
+	_kdfTime    uint32 = DefaultKdfTime
+	_kdfMemory  uint32 = DefaultKdfMemory
+	_kdfThreads uint8  = DefaultKdfThreads
 )
 
-func InitPassword(tmppw string) {
-	if len(tmppw) > 32 {
-		panic("password can only have 32 byte")
+// Parameters of the key derivation function, persisted in pocket_config as a single string.
+type KdfParams struct {
+	Algo    string
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+}
+
+// Create KdfParams with the configured cost parameters and a random salt.
+func NewKdfParams() (KdfParams, error) {
+	salt := make([]byte, KdfSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KdfParams{}, fmt.Errorf("failed to generate salt, %v", err)
+	}
+	k := KdfParams{
+		Algo:    KdfArgon2id,
+		Time:    _kdfTime,
+		Memory:  _kdfMemory,
+		Threads: _kdfThreads,
+		Salt:    salt,
+	}
+	if err := k.Validate(); err != nil {
+		return KdfParams{}, fmt.Errorf("illegal kdf params, %v", err)
+	}
+	return k, nil
+}
+
+// Check the cost parameters, argon2id needs at least 8 KiB of memory per thread.
+func (k KdfParams) Validate() error {
+	if k.Time < 1 || k.Time > MaxKdfTime {
+		return fmt.Errorf("kdf time should be within 1..%d", MaxKdfTime)
+	}
+	if k.Threads < 1 {
+		return fmt.Errorf("kdf threads should be within 1..%d", math.MaxUint8)
+	}
+	if least := 8 * uint32(k.Threads); k.Memory < least || k.Memory > MaxKdfMemory {
+		return fmt.Errorf("kdf memory should be within %d..%d KiB", least, MaxKdfMemory)
+	}
+	return nil
+}
+
+// Format params as 'argon2id$t=3$m=65536$p=4$<salt in hex>'.
+func (k KdfParams) String() string {
+	return fmt.Sprintf("%s$t=%d$m=%d$p=%d$%s", k.Algo, k.Time, k.Memory, k.Threads, hex.EncodeToString(k.Salt))
+}
+
+func ParseKdfParams(s string) (KdfParams, error) {
+	tokens := strings.Split(s, "$")
+	if len(tokens) != 5 || tokens[0] != KdfArgon2id {
+		return KdfParams{}, fmt.Errorf("unsupported kdf params '%v'", s)
+	}
+	k := KdfParams{Algo: tokens[0]}
+	for _, t := range tokens[1:4] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return KdfParams{}, fmt.Errorf("malformed kdf params '%v'", s)
+		}
+		v, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return KdfParams{}, fmt.Errorf("malformed kdf params '%v', %v", s, err)
+		}
+		switch kv[0] {
+		case "t":
+			k.Time = uint32(v)
+		case "m":
+			k.Memory = uint32(v)
+		case "p":
+			if v > math.MaxUint8 {
+				return KdfParams{}, fmt.Errorf("illegal kdf params '%v'", s)
+			}
+			k.Threads = uint8(v)
+		}
+	}
+	if err := k.Validate(); err != nil {
+		return KdfParams{}, fmt.Errorf("illegal kdf params '%v', %v", s, err)
+	}
+	salt, err := hex.DecodeString(tokens[4])
+	if err != nil || len(salt) < 1 {
+		return KdfParams{}, fmt.Errorf("malformed kdf salt '%v'", s)
+	}
+	k.Salt = salt
+	return k, nil
+}
+
+// Derive AES-256 key from the password.
+func (k KdfParams) DeriveKey(pw string) []byte {
+	b := []byte(pw)
+	defer wipeBytes(b)
+	return argon2.IDKey(b, k.Salt, k.Time, k.Memory, k.Threads, KeyLen)
+}
+
+// Key derivation used by the old versions, the password is simply zero-padded to 32 bytes.
+//
+// It's only kept to unlock (and then upgrade) vaults created by the old versions.
+func LegacyKey(tmppw string) ([]byte, error) {
+	if len(tmppw) > KeyLen {
+		return nil, errors.New("password can only have 32 byte")
 	}
-	_password = make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		if i < len(tmppw) {
-			_password[i] = tmppw[i]
-		} else {
-			break
+	key := make([]byte, KeyLen)
+	copy(key, tmppw)
+	return key, nil
+}
+
+// Set the key used by Encrypt and Decrypt, the key is copied to guarded memory and the given slice is zeroed.
+func InitKey(key []byte) {
+	_keyMu.Lock()
+	defer _keyMu.Unlock()
+	if _keyPage == nil {
+		page, err := newGuardedPage()
+		if err != nil {
+			Debugf("Failed to allocate guarded memory for key, %v", err)
+			page = make([]byte, KeyLen)
 		}
+		_keyPage = page
+	}
+	if len(key) > len(_keyPage) {
+		panic(fmt.Errorf("key is too long, %v bytes", len(key)))
+	}
+	if _restoreCoreDump == nil {
+		_restoreCoreDump = disableCoreDump()
+	}
+
+	k := _keyPage[len(_keyPage)-len(key):]
+	copy(k, key)
+	wipeBytes(_keyPage[:len(_keyPage)-len(key)])
+	if len(key) > 0 && &key[0] != &k[0] {
+		wipeBytes(key)
+	}
+	_password = k
+}
+
+// Zero and drop the key used by Encrypt and Decrypt, e.g., when the vault is locked or the app exits.
+//
+// It waits for the in-flight encryption and decryption, writes that come later fail with ErrVaultLocked.
+func WipeKey() {
+	_keyMu.Lock()
+	defer _keyMu.Unlock()
+	wipeBytes(_keyPage)
+	_password = nil
+	if _restoreCoreDump != nil {
+		_restoreCoreDump()
+		_restoreCoreDump = nil
 	}
 }
 
+// Run f with the key used by Encrypt and Decrypt, the key is not wiped until f returns.
+//
+// f must not call Encrypt, Decrypt or anything else that calls withKey.
+func withKey(f func(key []byte) error) error {
+	_keyMu.RLock()
+	defer _keyMu.RUnlock()
+	if _password == nil {
+		return ErrVaultLocked
+	}
+	return f(_password)
+}
+
+// Create a KeySlot that wraps the key used by Encrypt and Decrypt.
+func newVaultKeySlot(secret string) (KeySlot, error) {
+	var slot KeySlot
+	err := withKey(func(key []byte) (err error) {
+		slot, err = NewKeySlot(secret, key)
+		return err
+	})
+	return slot, err
+}
+
 func Encrypt0(s string) string {
 	v, _ := Encrypt(s)
 	return v
 }
 
 func Encrypt(s string) (string, error) {
-	aesCipher, err := aes.NewCipher(_password)
+	var v string
+	err := withKey(func(key []byte) (err error) {
+		v, err = EncryptWith(key, s)
+		return err
+	})
+	return v, err
+}
+
+func EncryptWith(key []byte, s string) (string, error) {
+	encrypted, err := Seal(key, []byte(s))
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher, %v", err)
+		return "", err
 	}
+	return hex.EncodeToString(encrypted), nil
+}
+
+// Encrypt data with AES-256-GCM, see seal.
+func Seal(key []byte, data []byte) ([]byte, error) {
+	return seal(EnvelopeV1, AlgAES256GCM, key, data, nil)
+}
+
+// Encrypt data with AES-256-GCM, the ciphertext is bound to the associated data (e.g., id of the row and name of the
+// column), it can't be decrypted with any other associated data, so it can't be moved to other rows or columns.
+func SealBound(key []byte, data []byte, ad string) ([]byte, error) {
+	return seal(EnvelopeV2, AlgAES256GCM, key, data, []byte(ad))
+}
 
-	gcm, err := cipher.NewGCM(aesCipher)
+// Encrypt data into a self-describing envelope:
+//
+//	version (1 byte) | algorithm id (1 byte) | key id (4 bytes) | nonce | ciphertext
+//
+// The header, followed by ad, is authenticated as associated data, so it can't be tampered with.
+func seal(version byte, alg byte, key []byte, data []byte, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(alg, key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM, %v", err)
+		return nil, err
 	}
+	out := make([]byte, envelopeHeaderLen+aead.NonceSize(), envelopeHeaderLen+aead.NonceSize()+len(data)+aead.Overhead())
+	out[0] = version
+	out[1] = alg
+	copy(out[2:envelopeHeaderLen], keyId(key))
 
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := out[envelopeHeaderLen:]
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to generate nonce, %v", err)
+		return nil, fmt.Errorf("failed to generate nonce, %v", err)
 	}
+	aad := append(append([]byte(nil), out[:envelopeHeaderLen]...), ad...)
+	return aead.Seal(out, nonce, data, aad), nil
+}
 
-	encrypted := gcm.Seal(nonce, nonce, []byte(s), nil)
+func newAEAD(alg byte, key []byte) (cipher.AEAD, error) {
+	switch alg {
+	case AlgAES256GCM:
+		aesCipher, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher, %v", err)
+		}
+		gcm, err := cipher.NewGCM(aesCipher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM, %v", err)
+		}
+		return gcm, nil
+	case AlgXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher, %v", err)
+		}
+		return aead, nil
+	}
+	return nil, fmt.Errorf("unsupported encryption algorithm %v", alg)
+}
+
+// Id of the key in envelope, it's the truncated HMAC-SHA256 of a fixed message, so that the key can't be derived
+// from it, but a value encrypted by another key can be told apart.
+func keyId(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pocket key id"))
+	return mac.Sum(nil)[:keyIdLen]
+}
+
+func EncryptBound(s string, ad string) (string, error) {
+	var v string
+	err := withKey(func(key []byte) (err error) {
+		v, err = EncryptBoundWith(key, s, ad)
+		return err
+	})
+	return v, err
+}
+
+func EncryptBoundWith(key []byte, s string, ad string) (string, error) {
+	encrypted, err := SealBound(key, []byte(s), ad)
+	if err != nil {
+		return "", err
+	}
 	return hex.EncodeToString(encrypted), nil
 }
 
@@ -60,32 +343,177 @@ func Decrypt0(s string) string {
 }
 
 func Decrypt(s string) (string, error) {
+	var v string
+	err := withKey(func(key []byte) (err error) {
+		v, err = DecryptWith(key, s)
+		return err
+	})
+	return v, err
+}
+
+func DecryptWith(key []byte, s string) (string, error) {
 	dec, _ := hex.DecodeString(s)
+	decrypted, err := Open(key, dec)
+	if err != nil {
+		return "", err
+	}
+	return string(decrypted), nil
+}
 
-	aesCipher, err := aes.NewCipher(_password)
+func DecryptBound(s string, ad string) (string, error) {
+	var v string
+	err := withKey(func(key []byte) (err error) {
+		v, err = DecryptBoundWith(key, s, ad)
+		return err
+	})
+	return v, err
+}
+
+func DecryptBoundWith(key []byte, s string, ad string) (string, error) {
+	dec, _ := hex.DecodeString(s)
+	decrypted, err := OpenBound(key, dec, ad)
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher, %v", err)
+		return "", err
+	}
+	return string(decrypted), nil
+}
+
+// Decrypt data encrypted by Seal, values encrypted by the old versions (without envelope header) are still supported.
+func Open(key []byte, dec []byte) ([]byte, error) {
+	if len(dec) < 1 || dec[0] != EnvelopeV1 {
+		return openLegacy(key, dec)
+	}
+	b, err := openEnvelope(key, dec, nil)
+	if err == nil {
+		return b, nil
 	}
+	// random nonce of the headerless value may start with the version byte by chance
+	if b, lerr := openLegacy(key, dec); lerr == nil {
+		return b, nil
+	}
+	return nil, err
+}
+
+// Decrypt data encrypted by SealBound with the same associated data, values that are not bound are rejected.
+func OpenBound(key []byte, dec []byte, ad string) ([]byte, error) {
+	if len(dec) < 1 || dec[0] != EnvelopeV2 {
+		return nil, ErrUnbound
+	}
+	return openEnvelope(key, dec, []byte(ad))
+}
 
-	gcm, err := cipher.NewGCM(aesCipher)
+func openEnvelope(key []byte, dec []byte, ad []byte) ([]byte, error) {
+	if len(dec) < envelopeHeaderLen {
+		return nil, errors.New("failed to decrypt, ciphertext too short")
+	}
+	aead, err := newAEAD(dec[1], key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM, %v", err)
+		return nil, err
+	}
+	if !hmac.Equal(dec[2:envelopeHeaderLen], keyId(key)) {
+		return nil, ErrKeyMismatch
+	}
+	if len(dec) < envelopeHeaderLen+aead.NonceSize() {
+		return nil, errors.New("failed to decrypt, ciphertext too short")
+	}
+	nonce := dec[envelopeHeaderLen : envelopeHeaderLen+aead.NonceSize()]
+	aad := append(append([]byte(nil), dec[:envelopeHeaderLen]...), ad...)
+	decrypted, err := aead.Open(nil, nonce, dec[envelopeHeaderLen+aead.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return decrypted, nil
+}
+
+// Decrypt headerless AES-256-GCM value, i.e., nonce followed by the ciphertext.
+func openLegacy(key []byte, dec []byte) ([]byte, error) {
+	gcm, err := newAEAD(AlgAES256GCM, key)
+	if err != nil {
+		return nil, err
 	}
 
+	if len(dec) < gcm.NonceSize() {
+		return nil, errors.New("failed to decrypt, ciphertext too short")
+	}
 	nonce := dec[:gcm.NonceSize()]
 
 	decrypted, err := gcm.Open(nil, nonce, dec[gcm.NonceSize():], nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt, %v", err)
+		return nil, fmt.Errorf("failed to decrypt, %v", err)
 	}
-	return string(decrypted), nil
+	return decrypted, nil
+}
+
+// Generate random vault data key, the key that actually encrypts the notes.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key, %v", err)
+	}
+	return key, nil
+}
+
+// Vault data key wrapped by a key derived from a secret (e.g., the password).
+//
+// Each unlock method has its own KeySlot, changing the secret only rewrites the slot.
+type KeySlot struct {
+	Kdf     KdfParams
+	Wrapped []byte
+}
+
+// Wrap data key with key derived from secret using newly generated KdfParams.
+func NewKeySlot(secret string, dataKey []byte) (KeySlot, error) {
+	params, err := NewKdfParams()
+	if err != nil {
+		return KeySlot{}, err
+	}
+	key := params.DeriveKey(secret)
+	defer wipeBytes(key)
+	wrapped, err := Seal(key, dataKey)
+	if err != nil {
+		return KeySlot{}, fmt.Errorf("failed to wrap data key, %v", err)
+	}
+	return KeySlot{Kdf: params, Wrapped: wrapped}, nil
+}
+
+// Unwrap the data key, returns false if the secret is incorrect.
+func (k KeySlot) Unlock(secret string) ([]byte, bool) {
+	key := k.Kdf.DeriveKey(secret)
+	defer wipeBytes(key)
+	dataKey, err := Open(key, k.Wrapped)
+	if err != nil {
+		Debugf("Failed to unwrap data key, %v", err)
+		return nil, false
+	}
+	return dataKey, true
+}
+
+// Format slot as '<kdf params>$<wrapped key in hex>'.
+func (k KeySlot) String() string {
+	return k.Kdf.String() + "$" + hex.EncodeToString(k.Wrapped)
+}
+
+func ParseKeySlot(s string) (KeySlot, error) {
+	i := strings.LastIndex(s, "$")
+	if i < 0 {
+		return KeySlot{}, fmt.Errorf("malformed key slot '%v'", s)
+	}
+	params, err := ParseKdfParams(s[:i])
+	if err != nil {
+		return KeySlot{}, err
+	}
+	wrapped, err := hex.DecodeString(s[i+1:])
+	if err != nil || len(wrapped) < 1 {
+		return KeySlot{}, fmt.Errorf("malformed key slot '%v'", s)
+	}
+	return KeySlot{Kdf: params, Wrapped: wrapped}, nil
 }
 
-// generate randon str based on given length and given charset
+// generate random str based on given length and given charset, see randInt
 func doRand(n int, set []rune) string {
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = set[mr.Intn(len(set))]
+		b[i] = set[randInt(len(set))]
 	}
 	return string(b)
 }
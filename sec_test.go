@@ -1,9 +1,18 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
 
 func TestEncrypt(t *testing.T) {
-	InitPassword("mypassword")
+	params, err := NewKdfParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitKey(params.DeriveKey("mypassword"))
 	dat := "mydata"
 	enc, err := Encrypt(dat)
 	if err != nil {
@@ -19,3 +28,208 @@ func TestEncrypt(t *testing.T) {
 		t.Fatal("result not match")
 	}
 }
+
+func TestWipeKey(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := append([]byte(nil), key...)
+	InitKey(key)
+	if !bytes.Equal(key, make([]byte, KeyLen)) || !bytes.Equal(_password, copied) {
+		t.Fatal("key should be moved to guarded memory")
+	}
+	k := _password
+	WipeKey()
+	if _password != nil || !bytes.Equal(k, make([]byte, KeyLen)) {
+		t.Fatal("key should be wiped")
+	}
+	if _, err := Encrypt("mydata"); !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("should fail to encrypt without key, %v", err)
+	}
+}
+
+func TestWipeKeyWaitsForInFlight(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitKey(key)
+	defer WipeKey()
+
+	wiped := make(chan struct{})
+	err = withKey(func(k []byte) error {
+		go func() {
+			WipeKey()
+			close(wiped)
+		}()
+		select {
+		case <-wiped:
+			t.Error("key wiped while in use")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if bytes.Equal(k, make([]byte, KeyLen)) {
+			t.Error("key wiped while in use")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-wiped
+	if _, err := EncryptBound("mydata", "ad"); !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("should fail to encrypt after the key is wiped, %v", err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	key, _ := NewDataKey()
+	other, _ := NewDataKey()
+
+	enc, err := Seal(key, []byte("mydata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc[0] != EnvelopeV1 || enc[1] != AlgAES256GCM || !bytes.Equal(enc[2:envelopeHeaderLen], keyId(key)) {
+		t.Fatalf("unexpected envelope header, %x", enc[:envelopeHeaderLen])
+	}
+	if dec, err := Open(key, enc); err != nil || string(dec) != "mydata" {
+		t.Fatalf("failed to open envelope, %v, %v", string(dec), err)
+	}
+	if _, err := Open(other, enc); err != ErrKeyMismatch {
+		t.Fatalf("expected %v, got %v", ErrKeyMismatch, err)
+	}
+	tampered := append([]byte(nil), enc...)
+	tampered[1] = AlgXChaCha20Poly1305
+	if _, err := Open(key, tampered); err == nil {
+		t.Fatal("tampered header should be rejected")
+	}
+
+	enc, err = seal(EnvelopeV1, AlgXChaCha20Poly1305, key, []byte("mydata"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := Open(key, enc); err != nil || string(dec) != "mydata" {
+		t.Fatalf("failed to open xchacha20-poly1305 envelope, %v, %v", string(dec), err)
+	}
+	if _, err := seal(EnvelopeV1, 0xff, key, []byte("mydata"), nil); err == nil {
+		t.Fatal("algorithm should be unsupported")
+	}
+
+	// headerless value encrypted by the old versions, the nonce may start with the version byte
+	gcm, _ := newAEAD(AlgAES256GCM, key)
+	for _, first := range []byte{0, EnvelopeV1} {
+		nonce := make([]byte, gcm.NonceSize())
+		nonce[0] = first
+		legacy := gcm.Seal(nonce, nonce, []byte("mydata"), nil)
+		if dec, err := Open(key, legacy); err != nil || string(dec) != "mydata" {
+			t.Fatalf("failed to open legacy value, %v, %v", string(dec), err)
+		}
+	}
+
+	bound, err := SealBound(key, []byte("mydata"), "pocket_note:1:content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := OpenBound(key, bound, "pocket_note:1:content"); err != nil || string(dec) != "mydata" {
+		t.Fatalf("failed to open bound envelope, %v, %v", string(dec), err)
+	}
+	if _, err := OpenBound(key, bound, "pocket_note:2:content"); err != ErrTampered {
+		t.Fatal("bound value should be rejected with other associated data")
+	}
+	if _, err := OpenBound(key, enc, "pocket_note:1:content"); err != ErrUnbound {
+		t.Fatalf("expected %v, got %v", ErrUnbound, err)
+	}
+}
+
+func TestKdfParams(t *testing.T) {
+	params := KdfParams{Algo: KdfArgon2id, Time: 1, Memory: 64, Threads: 1, Salt: []byte("0123456789abcdef")}
+	s := params.String()
+	t.Log(s)
+	parsed, err := ParseKdfParams(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != s {
+		t.Fatalf("parsed params not match, %v", parsed)
+	}
+	if !bytes.Equal(params.DeriveKey("mypassword"), parsed.DeriveKey("mypassword")) {
+		t.Fatal("derived key not match")
+	}
+	if bytes.Equal(params.DeriveKey("mypassword"), params.DeriveKey("mypassword2")) {
+		t.Fatal("different password derived the same key")
+	}
+
+	for _, s := range []string{"", "argon2id$t=1$m=64$p=1", "scrypt$t=1$m=64$p=1$00", "argon2id$t=0$m=64$p=1$00", "argon2id$t=1$m=64$p=257$00",
+		"argon2id$t=3$m=4$p=4$00", "argon2id$t=65$m=64$p=1$00", "argon2id$t=1$m=4294967296$p=1$00", "argon2id$t=1$m=4294967295$p=1$00"} {
+		if _, err := ParseKdfParams(s); err == nil {
+			t.Fatalf("should fail to parse '%v'", s)
+		}
+	}
+}
+
+func TestLegacyKey(t *testing.T) {
+	key, err := LegacyKey("mypassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != KeyLen || !bytes.Equal(key[:10], []byte("mypassword")) {
+		t.Fatalf("legacy key not match, %v", key)
+	}
+	if _, err := LegacyKey("0123456789012345678901234567890123"); err == nil {
+		t.Fatal("should reject password longer than 32 bytes")
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	_kdfMemory = 64
+	defer func() { _kdfMemory = DefaultKdfMemory }()
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, err := NewKeySlot("mypassword", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKeySlot(slot.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, ok := parsed.Unlock("mypassword")
+	if !ok || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatal("failed to unwrap data key")
+	}
+	if _, ok := parsed.Unlock("mypassword2"); ok {
+		t.Fatal("should fail to unwrap data key with incorrect password")
+	}
+}
+
+func TestKeySlotMinKdfParams(t *testing.T) {
+	defer func() { _kdfTime, _kdfMemory, _kdfThreads = DefaultKdfTime, DefaultKdfMemory, DefaultKdfThreads }()
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, threads := range []uint8{1, 4} {
+		_kdfTime, _kdfMemory, _kdfThreads = 1, 8*uint32(threads), threads
+		slot, err := NewKeySlot("mypassword", dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseKeySlot(slot.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unwrapped, ok := parsed.Unlock("mypassword"); !ok || !bytes.Equal(unwrapped, dataKey) {
+			t.Fatalf("failed to unwrap data key, %v", slot.Kdf)
+		}
+	}
+
+	_kdfTime, _kdfMemory, _kdfThreads = 3, 4, 4
+	if _, err := NewKeySlot("mypassword", dataKey); err == nil {
+		t.Fatal("should reject kdf memory less than 8 KiB per thread")
+	}
+}
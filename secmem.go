@@ -0,0 +1,8 @@
+package main
+
+// Zero the bytes, e.g., the key or the password that is no longer used.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Mark the process non-dumpable, it also prevents other processes of the same user from attaching to it (e.g., ptrace)
+// or reading its memory through /proc.
+func setNonDumpable() {
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		Debugf("Failed to set PR_SET_DUMPABLE, %v", err)
+	}
+}
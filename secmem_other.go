@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// Memory locking is not supported, the key is kept on heap but it's still wiped.
+func newGuardedPage() ([]byte, error) {
+	return make([]byte, os.Getpagesize()), nil
+}
+
+func disableCoreDump() (restore func()) {
+	return func() {}
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Map a page between two PROT_NONE guard pages, and lock it against swapping.
+//
+// The page is never unmapped, it's only zeroed, so that it's always safe to access.
+func newGuardedPage() ([]byte, error) {
+	ps := os.Getpagesize()
+	mem, err := unix.Mmap(-1, 0, 3*ps, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate memory, %v", err)
+	}
+	page := mem[ps : 2*ps]
+	if err := unix.Mprotect(page, unix.PROT_READ|unix.PROT_WRITE); err != nil {
+		unix.Munmap(mem)
+		return nil, fmt.Errorf("failed to protect memory, %v", err)
+	}
+	if err := unix.Mlock(page); err != nil {
+		// e.g., RLIMIT_MEMLOCK is too low, the key is still guarded and wiped
+		Debugf("Failed to lock memory, %v", err)
+	}
+	return page, nil
+}
+
+// Disable core dumps, returns func that restores the previous limit.
+func disableCoreDump() (restore func()) {
+	var old unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &old); err != nil {
+		Debugf("Failed to get RLIMIT_CORE, %v", err)
+		return func() {}
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: 0, Max: old.Max}); err != nil {
+		Debugf("Failed to disable core dumps, %v", err)
+		return func() {}
+	}
+	return func() {
+		if err := unix.Setrlimit(unix.RLIMIT_CORE, &old); err != nil {
+			Debugf("Failed to restore RLIMIT_CORE, %v", err)
+		}
+	}
+}
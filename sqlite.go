@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
 	"gorm.io/driver/sqlite"
@@ -15,14 +16,6 @@ const (
 	EnvSqliteFile = "POCKET_DB"
 )
 
-var (
-	sqliteDb *gorm.DB = nil
-)
-
-func GetDB() *gorm.DB {
-	return sqliteDb
-}
-
 func NewGormDebugLogger(debugOut io.Writer) logger.Interface {
 	return logger.New(log.New(debugOut, "\r\n", log.LstdFlags), logger.Config{
 		SlowThreshold:             200 * time.Millisecond,
@@ -32,15 +25,14 @@ func NewGormDebugLogger(debugOut io.Writer) logger.Interface {
 	})
 }
 
-func OpenDB(file string, debug bool, debugOut io.Writer) error {
+func OpenDB(file string, debug bool, debugOut io.Writer) (*gorm.DB, error) {
 	sq, err := newSqlite(file)
 	if err != nil {
-		return fmt.Errorf("failed to open SQLite file, file: %v, %v", file, err)
+		return nil, fmt.Errorf("failed to open SQLite file, file: %v, %v", file, err)
 	}
 	if debug {
 		sq.Logger = NewGormDebugLogger(debugOut)
 	}
-	sqliteDb = sq
 
 	// https://www.sqlite.org/pragma.html#pragma_journal_mode
 	Debugf("Enabling SQLite WAL mode")
@@ -51,7 +43,14 @@ func OpenDB(file string, debug bool, debugOut io.Writer) error {
 	} else {
 		Debugf("Enabled SQLite WAL mode, result: %v", mode)
 	}
-	return nil
+	return sq, nil
+}
+
+// Open SQLite file in read-only mode, the file is never created or modified.
+func OpenReadOnlyDB(file string) (*gorm.DB, error) {
+	// https://www.sqlite.org/uri.html
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(file)
+	return newSqlite("file:" + escaped + "?mode=ro")
 }
 
 func newSqlite(path string) (*gorm.DB, error) {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// notes having all the tags, the unary '+' stops SQLite from using rowid lookup on the FTS table,
+	// which otherwise silently drops rows when combined with MATCH ... OR MATCH ...
+	tagFilterSql = `+rowid IN (
+		SELECT nt.note_id FROM pocket_note_tag nt
+		JOIN pocket_tag t ON t.id = nt.tag_id
+		WHERE t.name IN ?
+		GROUP BY nt.note_id
+		HAVING count(*) = ?
+	)`
+)
+
+// Parse tags separated by comma or whitespace, tags are lower-cased, deduplicated and sorted.
+func ParseTags(s string) []string {
+	tokens := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	seen := map[string]struct{}{}
+	tags := []string{}
+	for _, t := range tokens {
+		t = strings.ToLower(t)
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func FormatTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// Whether the note has all the tags.
+func HasTags(n Note, tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, nt := range n.Tags {
+			if nt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags are many-to-many, pocket_tag stores the unique tag names, and pocket_note_tag links notes with tags.
+//
+// Tag names are not encrypted even if the note name and desc are encrypted.
+func createTagTables(tx *gorm.DB) error {
+	err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_tag (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE
+		)
+	`).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_note_tag (
+			note_id INTEGER NOT NULL,
+			tag_id INTEGER NOT NULL,
+			PRIMARY KEY (note_id, tag_id)
+		)
+	`).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE INDEX IF NOT EXISTS note_tag_tag_idx ON pocket_note_tag (tag_id)`).Error
+}
+
+// Replace tags of the note, tags that are no longer used by any note are removed.
+func setNoteTags(tx *gorm.DB, noteId int, tags []string) error {
+	if err := tx.Exec(`DELETE FROM pocket_note_tag WHERE note_id = ?`, noteId).Error; err != nil {
+		return fmt.Errorf("failed to update pocket_note_tag, %v", err)
+	}
+	for _, t := range tags {
+		if err := tx.Exec(`INSERT OR IGNORE INTO pocket_tag (name) VALUES (?)`, t).Error; err != nil {
+			return fmt.Errorf("failed to save pocket_tag, %v", err)
+		}
+		err := tx.Exec(`INSERT OR IGNORE INTO pocket_note_tag (note_id, tag_id) SELECT ?, id FROM pocket_tag WHERE name = ?`, noteId, t).Error
+		if err != nil {
+			return fmt.Errorf("failed to save pocket_note_tag, %v", err)
+		}
+	}
+	return removeUnusedTags(tx)
+}
+
+func removeUnusedTags(tx *gorm.DB) error {
+	err := tx.Exec(`DELETE FROM pocket_tag WHERE id NOT IN (SELECT tag_id FROM pocket_note_tag)`).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove unused pocket_tag, %v", err)
+	}
+	return nil
+}
+
+// Load tags of the notes.
+func loadNoteTags(db *gorm.DB, notes []Note) error {
+	if len(notes) < 1 {
+		return nil
+	}
+	ids := make([]int, 0, len(notes))
+	for _, n := range notes {
+		ids = append(ids, n.Id)
+	}
+
+	var rows []struct {
+		NoteId int
+		Name   string
+	}
+	err := db.Raw(`
+		SELECT nt.note_id, t.name FROM pocket_note_tag nt
+		JOIN pocket_tag t ON t.id = nt.tag_id
+		WHERE nt.note_id IN ?
+		ORDER BY t.name
+	`, ids).Scan(&rows).Error
+	if err != nil {
+		return fmt.Errorf("failed to query note tags, %v", err)
+	}
+
+	byNote := map[int][]string{}
+	for _, r := range rows {
+		byNote[r.NoteId] = append(byNote[r.NoteId], r.Name)
+	}
+	for i := range notes {
+		notes[i].Tags = byNote[notes[i].Id]
+	}
+	return nil
+}
+
+// Find ids of notes having all the tags.
+func findNoteIdsByTags(db *gorm.DB, tags []string) (map[int]struct{}, error) {
+	var ids []int
+	err := db.Table("pocket_note").
+		Select("rowid").
+		Where(tagFilterSql, tags, len(tags)).
+		Scan(&ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes by tags, %v", err)
+	}
+	set := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set, nil
+}
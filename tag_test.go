@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	cases := []struct {
+		s    string
+		tags []string
+	}{
+		{"", []string{}},
+		{"aws", []string{"aws"}},
+		{" Prod, aws  prod,,", []string{"aws", "prod"}},
+		{"b\ta\nc", []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		if tags := ParseTags(c.s); !reflect.DeepEqual(tags, c.tags) {
+			t.Fatalf("ParseTags(%q) = %v, expected %v", c.s, tags, c.tags)
+		}
+	}
+}
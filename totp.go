@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	DefaultTotpDigits = 6
+	DefaultTotpPeriod = 30
+)
+
+var ErrNoTotp = errors.New("note doesn't have TOTP secret")
+
+// Time-based one-time password generator (RFC 6238).
+type TOTP struct {
+	Secret    []byte
+	Algorithm string // SHA1, SHA256 or SHA512
+	Digits    int
+	Period    int // in seconds
+	Issuer    string
+	Account   string
+}
+
+// Parse otpauth:// URI (e.g., 'otpauth://totp/GitHub:alice?secret=JBSWY3DPEHPK3PXP&issuer=GitHub') or base32 secret.
+func ParseTOTP(s string) (TOTP, error) {
+	s = strings.TrimSpace(s)
+	t := TOTP{Algorithm: "SHA1", Digits: DefaultTotpDigits, Period: DefaultTotpPeriod}
+	if !strings.HasPrefix(strings.ToLower(s), "otpauth://") {
+		secret, err := decodeBase32Secret(s)
+		if err != nil {
+			return TOTP{}, err
+		}
+		t.Secret = secret
+		return t, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return TOTP{}, fmt.Errorf("invalid otpauth uri, %v", err)
+	}
+	if !strings.EqualFold(u.Host, "totp") {
+		return TOTP{}, fmt.Errorf("unsupported otp type '%v', only totp is supported", u.Host)
+	}
+	label := strings.TrimPrefix(u.Path, "/")
+	if issuer, account, ok := strings.Cut(label, ":"); ok {
+		t.Issuer, t.Account = issuer, strings.TrimSpace(account)
+	} else {
+		t.Account = label
+	}
+
+	q := u.Query()
+	if t.Secret, err = decodeBase32Secret(q.Get("secret")); err != nil {
+		return TOTP{}, err
+	}
+	if v := q.Get("issuer"); v != "" {
+		t.Issuer = v
+	}
+	if v := q.Get("algorithm"); v != "" {
+		t.Algorithm = strings.ToUpper(v)
+		if t.Algorithm != "SHA1" && t.Algorithm != "SHA256" && t.Algorithm != "SHA512" {
+			return TOTP{}, fmt.Errorf("unsupported algorithm '%v'", v)
+		}
+	}
+	if v := q.Get("digits"); v != "" {
+		if t.Digits, err = cast.ToIntE(v); err != nil || t.Digits < 6 || t.Digits > 8 {
+			return TOTP{}, fmt.Errorf("invalid digits '%v', should be 6, 7 or 8", v)
+		}
+	}
+	if v := q.Get("period"); v != "" {
+		if t.Period, err = cast.ToIntE(v); err != nil || t.Period < 1 {
+			return TOTP{}, fmt.Errorf("invalid period '%v'", v)
+		}
+	}
+	return t, nil
+}
+
+// Decode base32 secret, spaces and dashes are ignored, and padding is optional.
+func decodeBase32Secret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "=", "").Replace(s))
+	if s == "" {
+		return nil, errors.New("TOTP secret is empty")
+	}
+	if n := len(s) % 8; n != 0 {
+		s += strings.Repeat("=", 8-n)
+	}
+	secret, err := base32.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 secret, %v", err)
+	}
+	return secret, nil
+}
+
+// Generate code at the time.
+func (t TOTP) Code(at time.Time) string {
+	var h func() hash.Hash
+	switch t.Algorithm {
+	case "SHA256":
+		h = sha256.New
+	case "SHA512":
+		h = sha512.New
+	default:
+		h = sha1.New
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/int64(t.Period)))
+	mac := hmac.New(h, t.Secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, see RFC 4226
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < t.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", t.Digits, bin%mod)
+}
+
+// Time left before the code at the time expires.
+func (t TOTP) Remaining(at time.Time) time.Duration {
+	period := time.Duration(t.Period) * time.Second
+	return period - time.Duration(at.UnixNano())%period
+}
+
+// Find TOTP of the note, it's the first totp field, or the content if it's an otpauth:// URI.
+func NoteTOTP(n Note) (TOTP, error) {
+	if f, ok := FindField(n.Fields, FieldTOTP); ok {
+		return ParseTOTP(f.Value)
+	}
+	if strings.HasPrefix(strings.TrimSpace(n.Content), "otpauth://totp/") {
+		return ParseTOTP(n.Content)
+	}
+	return TOTP{}, ErrNoTotp
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238 appendix B
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	vectors := []struct {
+		unix int64
+		algo string
+		code string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+	for _, v := range vectors {
+		secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(secrets[v.algo]))
+		tp, err := ParseTOTP("otpauth://totp/ACME:alice?secret=" + secret + "&algorithm=" + v.algo + "&digits=8&period=30")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := tp.Code(time.Unix(v.unix, 0)); c != v.code {
+			t.Fatalf("%v at %v, expected %v, got %v", v.algo, v.unix, v.code, c)
+		}
+	}
+
+	tp, err := ParseTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := tp.Code(time.Unix(59, 0)); c != "287082" {
+		t.Fatalf("unexpected code, %v", c)
+	}
+	if r := tp.Remaining(time.Unix(59, 0)); r != time.Second {
+		t.Fatalf("unexpected remaining, %v", r)
+	}
+
+	for _, s := range []string{"", "not base32!", "otpauth://hotp/x?secret=GEZDGNBV", "otpauth://totp/x?secret=GEZDGNBV&digits=10"} {
+		if _, err := ParseTOTP(s); err == nil {
+			t.Fatalf("'%v' should be invalid", s)
+		}
+	}
+}
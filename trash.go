@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	CKeyTrashDays    = "TrashRetentionDays"
+	DefaultTrashDays = 0 // notes are never purged until the retention is set
+
+	// notes that are not in trash, see tagFilterSql for the unary '+'
+	notTrashedSql = `+rowid NOT IN (SELECT note_id FROM pocket_note_trash)`
+)
+
+var (
+	ErrNoteNotInTrash = errors.New("note is not in trash")
+	ErrNoteInTrash    = errors.New("note is in trash, restore it first")
+)
+
+type TrashedNote struct {
+	Note
+	Dtime ETime // when the note is moved to trash
+}
+
+// Deleted notes are kept in pocket_note until they are purged, pocket_note_trash records when they are deleted, see
+// createRevisionTable for the type of dtime.
+func createTrashTable(tx *gorm.DB) error {
+	return tx.Exec(`
+		CREATE TABLE IF NOT EXISTS pocket_note_trash (
+			note_id INTEGER PRIMARY KEY,
+			dtime TEXT NOT NULL
+		)
+	`).Error
+}
+
+// Fetch notes in trash, latest deleted first.
+func (s *SqliteStorage) FetchTrash() ([]TrashedNote, error) {
+	var rows []struct {
+		Id    int
+		Dtime ETime
+	}
+	if err := s.db.Raw(`SELECT note_id id, dtime FROM pocket_note_trash ORDER BY dtime DESC, note_id DESC`).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to query pocket_note_trash, %v", err)
+	}
+	trashed := make([]TrashedNote, 0, len(rows))
+	for _, r := range rows {
+		n, err := s.fetchNote(r.Id)
+		if err != nil {
+			return nil, err
+		}
+		trashed = append(trashed, TrashedNote{Note: n, Dtime: r.Dtime})
+	}
+	return trashed, nil
+}
+
+// Move the note out of trash.
+func (s *SqliteStorage) RestoreNote(id int) error {
+	t := s.db.Exec(`DELETE FROM pocket_note_trash WHERE note_id = ?`, id)
+	if t.Error != nil {
+		return fmt.Errorf("failed to update pocket_note_trash, %v", t.Error)
+	}
+	if t.RowsAffected < 1 {
+		return ErrNoteNotInTrash
+	}
+	if s.encryptMeta {
+		n, err := s.fetchNote(id)
+		if err != nil {
+			return err
+		}
+		s.metaIndex.Put(n)
+	}
+	return nil
+}
+
+// Permanently delete the note in trash.
+func (s *SqliteStorage) PurgeNote(id int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if trashed, err := isTrashed(tx, id); err != nil {
+			return err
+		} else if !trashed {
+			return ErrNoteNotInTrash
+		}
+		return purgeNote(tx, id)
+	})
+}
+
+func isTrashed(db *gorm.DB, id int) (bool, error) {
+	var n int
+	if err := db.Raw(`SELECT count(*) FROM pocket_note_trash WHERE note_id = ?`, id).Scan(&n).Error; err != nil {
+		return false, fmt.Errorf("failed to query pocket_note_trash, %v", err)
+	}
+	return n > 0, nil
+}
+
+// Permanently delete notes that have been in trash for at least the given duration, returns number of purged notes.
+func (s *SqliteStorage) PurgeTrash(age time.Duration) (int, error) {
+	return purgeTrash(s.db, age)
+}
+
+func purgeTrash(db *gorm.DB, age time.Duration) (int, error) {
+	var ids []int
+	err := db.Raw(`SELECT note_id FROM pocket_note_trash WHERE dtime <= ?`, ETime(time.Now().Add(-age))).
+		Scan(&ids).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to query pocket_note_trash, %v", err)
+	}
+	if len(ids) < 1 {
+		return 0, nil
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			if err := purgeNote(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func purgeNote(tx *gorm.DB, id int) error {
+	if err := tx.Exec(`DELETE FROM pocket_note WHERE rowid = ?`, id).Error; err != nil {
+		return fmt.Errorf("failed to delete pocket_note, %v", err)
+	}
+	if err := setNoteNotebook(tx, id, ""); err != nil {
+		return err
+	}
+	if err := deleteRevisions(tx, id); err != nil {
+		return err
+	}
+	if err := deleteAttachments(tx, id); err != nil {
+		return err
+	}
+	if err := deleteFields(tx, id); err != nil {
+		return err
+	}
+	if err := setNoteTags(tx, id, nil); err != nil {
+		return err
+	}
+	if err := tx.Exec(`DELETE FROM pocket_note_trash WHERE note_id = ?`, id).Error; err != nil {
+		return fmt.Errorf("failed to delete pocket_note_trash, %v", err)
+	}
+	return nil
+}
+
+// Number of days notes are kept in trash before they are purged by PurgeExpiredTrash, 0 means never.
+func (s *SqliteStorage) TrashRetention() (int, error) {
+	return loadTrashRetention(s.db)
+}
+
+func loadTrashRetention(db *gorm.DB) (int, error) {
+	v, ok, err := GetConfig(db, CKeyTrashDays)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return DefaultTrashDays, nil
+	}
+	var days int
+	if _, err := fmt.Sscan(v, &days); err != nil || days < 0 {
+		return 0, fmt.Errorf("invalid %v '%v', database may be corrupted", CKeyTrashDays, v)
+	}
+	return days, nil
+}
+
+func (s *SqliteStorage) SetTrashRetention(days int) error {
+	if days < 0 {
+		return errors.New("number of days must not be negative")
+	}
+	return SetConfig(s.db, CKeyTrashDays, fmt.Sprint(days))
+}
+
+// Purge notes that have been in trash for longer than the retention, returns the number of purged notes.
+func (s *SqliteStorage) PurgeExpiredTrash() (int, error) {
+	days, err := loadTrashRetention(s.db)
+	if err != nil || days < 1 {
+		return 0, err
+	}
+	n, err := purgeTrash(s.db, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		Debugf("Purged %v notes that have been in trash for more than %v days", n, days)
+	}
+	return n, nil
+}
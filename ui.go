@@ -4,8 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -23,12 +24,28 @@ const (
 	PageMsg      = "message"
 	PageExit     = "exit"
 	PageConfirm  = "confirm"
+	PageChangePw = "change-password"
+	PageMerge    = "merge"
+	PageMove     = "move"
+	PageHistory  = "history"
+	PageTrash    = "trash"
+	PageTrashCfg = "trash-config"
+	PageAttach   = "attach"
+	PageField    = "field"
+	PageGen      = "generator"
+	PageRecovery = "recovery"
+	PageRecover  = "recover"
+	PageEditor   = "editor"
 
 	PageLimit = 5
 
-	LabelName    = "Name:"
-	LabelDesc    = "Description:"
-	LabelContent = "Content:"
+	DefaultLockTimeout = 5 * time.Minute
+
+	LabelName     = "Name:"
+	LabelDesc     = "Description:"
+	LabelContent  = "Content:"
+	LabelTags     = "Tags:"
+	LabelNotebook = "Notebook:"
 )
 
 var (
@@ -37,13 +54,62 @@ var (
 	KeyTabEvt     = tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone)
 	KeyBackTabEvt = tcell.NewEventKey(tcell.KeyBacktab, 0, tcell.ModNone)
 	KeyEscEvt     = tcell.NewEventKey(tcell.KeyESC, 0, tcell.ModNone)
+
+	// vault is locked after being idle for the timeout, 0 never locks it
+	_lockTimeout = DefaultLockTimeout
 )
 
 type Pocket struct {
 	*tview.Application
+	Storage    Storage
 	Pages      *tview.Pages
 	DetailPage *DetailPage
 	ListPage   *ListPage
+
+	pwField   *tview.InputField // password field of PagePassword, cleared once unlocked or locked
+	locked    atomic.Bool
+	lastInput atomic.Int64 // unix nano of the last input event
+}
+
+// Pages that are popped up on top of the list or detail page, they are removed when the vault is locked.
+var popupPages = []string{PageSearch, PageCreate, PageEdit, PageDelete, PageMsg, PageConfirm, PageChangePw, PageMerge,
+	PageMove, PageHistory, PageTrash, PageTrashCfg, PageAttach, PageField, PageGen,
+	PageRecovery, PageRecover, PageEditor}
+
+// Record activity, the idle timer of auto-lock starts over.
+func (p *Pocket) Touch() {
+	p.lastInput.Store(time.Now().UnixNano())
+}
+
+func (p *Pocket) idleFor() time.Duration {
+	return time.Since(time.Unix(0, p.lastInput.Load()))
+}
+
+// Lock the vault when there is no input event for _lockTimeout.
+func (p *Pocket) watchIdle() {
+	if _lockTimeout <= 0 {
+		return
+	}
+	p.Touch()
+	p.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		p.Touch()
+		return event
+	})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if p.locked.Load() || p.idleFor() < _lockTimeout {
+				continue
+			}
+			// checked again in the UI goroutine, e.g., the app may be suspended by the external editor in the meantime
+			p.QueueUpdateDraw(func() {
+				if !p.locked.Load() && p.idleFor() >= _lockTimeout {
+					UILockVault(p)
+				}
+			})
+		}
+	}()
 }
 
 func (p *Pocket) ToPage(page string) {
@@ -57,7 +123,8 @@ func (p *Pocket) RemovePage(page string) {
 type ListPage struct {
 	*tview.Flex
 	*ListView
-	Options *tview.List
+	Options   *tview.List
+	Notebooks *tview.TreeView
 }
 
 func (l *ListPage) SetPage(n int) {
@@ -124,6 +191,7 @@ func NewListPage(pocket *Pocket) *ListPage {
 		}
 		return nil, false
 	}
+	tree := NewNotebookTree(pocket)
 	opt := NewOptionList(extendedCap).
 		AddItem("Create Item", "", 'c', func() {
 			PopCreateNotePage(pocket, func() {
@@ -136,6 +204,9 @@ func NewListPage(pocket *Pocket) *ListPage {
 		AddItem("Search Param", "", '/', func() {
 			PopEditSearchPage(pocket)
 		}).
+		AddItem("Notebooks", "", 't', func() {
+			pocket.SetFocus(tree)
+		}).
 		AddItem("Next Page", "", 'n', func() {
 			UIFetchNotes(pocket, 1)
 		}).
@@ -144,12 +215,34 @@ func NewListPage(pocket *Pocket) *ListPage {
 				UIFetchNotes(pocket, -1)
 			}
 		}).
+		AddItem("Trash", "", 'T', func() {
+			PopTrashPage(pocket)
+		}).
+		AddItem("Change Password", "", 'p', func() {
+			PopChangePasswordPage(pocket)
+		}).
+		AddItem("Encrypt Name/Desc", "", 'E', func() {
+			PopEncryptMetaPage(pocket)
+		}).
+		AddItem("Merge Vault", "", 'M', func() {
+			PopMergePage(pocket)
+		}).
+		AddItem("Recovery Codes", "", 'R', func() {
+			PopRegenerateRecoveryPage(pocket)
+		}).
+		AddItem("Editor", "", 'e', func() {
+			PopEditorPage(pocket)
+		}).
+		AddItem("Lock", "", 'L', func() {
+			UILockVault(pocket)
+		}).
 		AddItem("Exit", "", 'q', func() {
 			PopExitPage(pocket)
 		})
 
-	cp := NewContentPlane(opt, lv.flex)
+	cp := NewContentPlane(opt, tree, lv.flex)
 	lp.Options = opt
+	lp.Notebooks = tree
 	lp.ListView = lv
 	lp.Flex = cp
 
@@ -165,20 +258,25 @@ func PopEditSearchPage(pocket *Pocket) {
 	}
 
 	prevName := liv.name.Text
+	prevTags := liv.tags.Text
 	var tmpName string = ""
+	var tmpTags string = ""
 
 	form := NewForm(false)
 	form.AddInputField("Match (supports AND/OR):", tmpName, 80, nil, func(t string) { tmpName = t })
+	form.AddInputField("Tags (comma separated):", tmpTags, 80, nil, func(t string) { tmpTags = t })
 	form.SetCancelFunc(closePopup)
 	form.SetButtonsAlign(tview.AlignCenter)
 	form.SetBorder(true).SetTitle(" Search Parameters ")
 	form.SetInputCapture(func(evt *tcell.EventKey) *tcell.EventKey {
 		if evt.Key() == tcell.KeyEnter {
+			tmpTags = FormatTags(ParseTags(tmpTags))
 			liv.name.SetText(tmpName)
+			liv.tags.SetText(tmpTags)
 			liv.pageNum = 1
 			liv.page.SetText("1")
 			closePopup()
-			if prevName != tmpName {
+			if prevName != tmpName || prevTags != tmpTags {
 				UIFetchNotes(pocket, 0)
 			}
 			return nil
@@ -186,7 +284,7 @@ func PopEditSearchPage(pocket *Pocket) {
 		return evt
 	})
 
-	popup := createPopup(form, 5, 110)
+	popup := createPopup(form, 7, 110)
 	pages.AddPage(PageSearch, popup, true, true)
 }
 
@@ -200,12 +298,13 @@ func PopEditNotePage(pocket *Pocket, it Note) {
 	form := NewForm(true)
 	form.AddTextArea(LabelName, it.Name, 100, 2, 30, nil)
 	form.AddTextArea(LabelDesc, it.Desc, 100, 5, 250, nil)
+	form.AddTextArea(LabelTags, FormatTags(it.Tags), 100, 2, 250, nil)
 	form.AddTextArea(LabelContent, it.Content, 100, 20, 10000, nil)
 
 	newInputCap := func(t *tview.TextArea) func(event *tcell.EventKey) *tcell.EventKey {
 		return func(event *tcell.EventKey) *tcell.EventKey {
 			if event.Key() == tcell.KeyEnter {
-				VimEdit(pocket, t.GetText(), func(s string) { t.SetText(strings.TrimSpace(s), true) })
+				ExternalEdit(pocket, t.GetText(), func(s string) { t.SetText(strings.TrimSpace(s), true) })
 				return nil
 			}
 			return event
@@ -215,20 +314,26 @@ func PopEditNotePage(pocket *Pocket, it Note) {
 	// this is so ugly :(, but it works
 	ni := form.GetFormItemByLabel(LabelName).(*tview.TextArea)
 	di := form.GetFormItemByLabel(LabelDesc).(*tview.TextArea)
+	ti := form.GetFormItemByLabel(LabelTags).(*tview.TextArea)
 	ci := form.GetFormItemByLabel(LabelContent).(*tview.TextArea)
 
 	ni.SetInputCapture(newInputCap(ni))
 	di.SetInputCapture(newInputCap(di))
+	ti.SetInputCapture(newInputCap(ti))
 	ci.SetInputCapture(newInputCap(ci))
+	bindGenerator(pocket, form)
 
 	confirm := func() {
 		ni := Note{
-			Id:      it.Id,
-			Name:    ni.GetText(),
-			Desc:    di.GetText(),
-			Content: ci.GetText(),
-			Ctime:   it.Ctime,
-			Utime:   Now(),
+			Id:       it.Id,
+			Name:     ni.GetText(),
+			Desc:     di.GetText(),
+			Content:  ci.GetText(),
+			Tags:     ParseTags(ti.GetText()),
+			Notebook: it.Notebook,
+			Fields:   it.Fields,
+			Ctime:    it.Ctime,
+			Utime:    Now(),
 		}
 		UIEditNote(pocket, ni, func(err error) {
 			if err == nil {
@@ -241,16 +346,16 @@ func PopEditNotePage(pocket *Pocket, it Note) {
 	form.AddButton("Confirm", confirm)
 	form.AddButton("Close", closePopup)
 	form.SetCancelFunc(func() {
-		if ni.GetText() == it.Name && di.GetText() == it.Desc && ci.GetText() == it.Content {
+		if ni.GetText() == it.Name && di.GetText() == it.Desc && ti.GetText() == FormatTags(it.Tags) && ci.GetText() == it.Content {
 			closePopup()
 			return
 		}
 		PopConfirmDialog(pocket, closePopup, "Close Dialog?", 50, 15)
 	})
 	form.SetButtonsAlign(tview.AlignCenter)
-	form.SetBorder(true).SetTitle(" Edit Note (vim-based) ")
+	form.SetBorder(true).SetTitle(" Edit Note (editor-based, 'g' to generate password) ")
 
-	popup := createPopup(form, 35, 100)
+	popup := createPopup(form, 38, 100)
 	pocket.Pages.AddPage(PageEdit, popup, true, true)
 }
 
@@ -263,12 +368,14 @@ func PopCreateNotePage(pocket *Pocket, onConfirm func()) {
 	form := NewForm(true)
 	form.AddTextArea(LabelName, "", 100, 2, 30, nil)
 	form.AddTextArea(LabelDesc, "", 100, 5, 250, nil)
+	form.AddTextArea(LabelTags, "", 100, 2, 250, nil)
+	form.AddTextArea(LabelNotebook, pocket.ListPage.notebook, 100, 2, 250, nil)
 	form.AddTextArea(LabelContent, "", 100, 20, 10000, nil)
 
 	newInputCap := func(t *tview.TextArea) func(event *tcell.EventKey) *tcell.EventKey {
 		return func(event *tcell.EventKey) *tcell.EventKey {
 			if event.Key() == tcell.KeyEnter {
-				VimEdit(pocket, t.GetText(), func(s string) { t.SetText(strings.TrimSpace(s), true) })
+				ExternalEdit(pocket, t.GetText(), func(s string) { t.SetText(strings.TrimSpace(s), true) })
 				return nil
 			}
 			return event
@@ -278,20 +385,27 @@ func PopCreateNotePage(pocket *Pocket, onConfirm func()) {
 	// this is so ugly :(, but it works
 	ni := form.GetFormItemByLabel(LabelName).(*tview.TextArea)
 	di := form.GetFormItemByLabel(LabelDesc).(*tview.TextArea)
+	ti := form.GetFormItemByLabel(LabelTags).(*tview.TextArea)
+	bi := form.GetFormItemByLabel(LabelNotebook).(*tview.TextArea)
 	ci := form.GetFormItemByLabel(LabelContent).(*tview.TextArea)
 
 	ni.SetInputCapture(newInputCap(ni))
 	di.SetInputCapture(newInputCap(di))
+	ti.SetInputCapture(newInputCap(ti))
+	bi.SetInputCapture(newInputCap(bi))
 	ci.SetInputCapture(newInputCap(ci))
+	bindGenerator(pocket, form)
 
 	confirm := func() {
 		ctime := Now()
 		note := Note{
-			Name:    ni.GetText(),
-			Desc:    di.GetText(),
-			Content: ci.GetText(),
-			Ctime:   ctime,
-			Utime:   ctime,
+			Name:     ni.GetText(),
+			Desc:     di.GetText(),
+			Content:  ci.GetText(),
+			Tags:     ParseTags(ti.GetText()),
+			Notebook: bi.GetText(),
+			Ctime:    ctime,
+			Utime:    ctime,
 		}
 		UICreateNote(pocket, note, func(nt Note, err error) {
 			pocket.ToPage(PageList)
@@ -308,16 +422,16 @@ func PopCreateNotePage(pocket *Pocket, onConfirm func()) {
 	form.AddButton("Confirm", confirm)
 	form.AddButton("Close", closePopup)
 	form.SetCancelFunc(func() {
-		if ni.GetText() == "" && di.GetText() == "" && ci.GetText() == "" {
+		if ni.GetText() == "" && di.GetText() == "" && ti.GetText() == "" && ci.GetText() == "" {
 			closePopup()
 			return
 		}
 		PopConfirmDialog(pocket, closePopup, "Close Dialog?", 50, 15)
 	})
 	form.SetButtonsAlign(tview.AlignCenter)
-	form.SetBorder(true).SetTitle(" Create Note (vim-based) ")
+	form.SetBorder(true).SetTitle(" Create Note (editor-based, 'g' to generate password) ")
 
-	popup := createPopup(form, 35, 120)
+	popup := createPopup(form, 41, 120)
 	pocket.Pages.AddPage(PageCreate, popup, true, true)
 }
 
@@ -343,6 +457,7 @@ func NewDetailPage(pocket *Pocket) *DetailPage {
 	vw := NewDetailView(pocket)
 	extendedInputCap := func(e *tcell.EventKey) (*tcell.EventKey, bool) {
 		if e.Rune() == 'h' || e.Key() == tcell.KeyESC || e.Key() == tcell.KeyLeft {
+			vw.StopTOTP()
 			pocket.Pages.SwitchToPage(PageList)
 			UIFetchNotes(pocket, 0, func() { pocket.ListPage.FocusOne(pocket) })
 			return nil, true
@@ -358,12 +473,37 @@ func NewDetailPage(pocket *Pocket) *DetailPage {
 			PopDeleteNotePage(pocket, vw.Item)
 		}).
 		AddItem("Mask/Unmask", "", 'm', vw.SwitchMasking).
+		AddItem("Copy", "", 'y', vw.CopyContent).
+		AddItem("Fields", "", 'f', func() {
+			if !vw.FocusFields() {
+				PopMsg(pocket, nil, "Note has no field, press 'F' to add one")
+			}
+		}).
+		AddItem("Add Field", "", 'F', func() {
+			PopEditFieldPage(pocket, vw.Item, -1)
+		}).
+		AddItem("Move", "", 'v', func() {
+			PopMoveNotePage(pocket, vw.Item)
+		}).
+		AddItem("History", "", 'H', func() {
+			PopHistoryPage(pocket, vw.Item)
+		}).
+		AddItem("Attach File", "", 'a', func() {
+			PopAttachFilePage(pocket, vw.Item)
+		}).
+		AddItem("Extract File", "", 'x', func() {
+			PopExtractFilePage(pocket, vw.Attachments)
+		}).
+		AddItem("Delete File", "", 'X', func() {
+			PopDeleteFilePage(pocket, vw.Item, vw.Attachments)
+		}).
 		AddItem("Exit", "", 'q', func() {
+			vw.StopTOTP()
 			pocket.Pages.SwitchToPage(PageList)
 			UIFetchNotes(pocket, 0, func() { pocket.ListPage.FocusOne(pocket) })
 		})
 
-	p := NewContentPlane(options, vw.flex)
+	p := NewContentPlane(options, nil, vw.flex)
 
 	dp.Flex = p
 	dp.Options = options
@@ -371,11 +511,12 @@ func NewDetailPage(pocket *Pocket) *DetailPage {
 	return dp
 }
 
-func NewApp() *Pocket {
+func NewApp(st Storage) *Pocket {
 	app := tview.NewApplication()
 	pages := tview.NewPages()
 	pocket := &Pocket{
 		Application: app,
+		Storage:     st,
 		Pages:       pages,
 	}
 
@@ -387,16 +528,22 @@ func NewApp() *Pocket {
 
 	pages.AddPage(PageDetail, detailPage, true, true)
 	pages.AddPage(PageList, listPage, true, true)
+	pocket.locked.Store(true)
 	PopPasswordPage(pocket)
 	app.SetRoot(pages, true)
+	pocket.watchIdle()
 
 	return pocket
 }
 
-func NewContentPlane(options tview.Primitive, content tview.Primitive) *tview.Flex {
+// Options on the left, followed by the optional navigator (can be nil) and the content.
+func NewContentPlane(options tview.Primitive, nav tview.Primitive, content tview.Primitive) *tview.Flex {
 	ctnp := tview.NewFlex().SetDirection(tview.FlexColumn).
-		AddItem(options, 30, 1, true).
-		AddItem(content, 0, 4, false)
+		AddItem(options, 30, 1, true)
+	if nav != nil {
+		ctnp.AddItem(nav, 30, 1, false)
+	}
+	ctnp.AddItem(content, 0, 4, false)
 
 	ver := tview.NewTextView()
 	ver.SetBorder(true)
@@ -430,21 +577,80 @@ func NewOptionList(extendedCap func(event *tcell.EventKey) (*tcell.EventKey, boo
 	return l
 }
 
+// Tree of notebooks, selecting a notebook lists notes in the notebook and its descendants.
+func NewNotebookTree(pocket *Pocket) *tview.TreeView {
+	root := tview.NewTreeNode(NotebookSep).SetReference("")
+	tree := tview.NewTreeView().SetRoot(root).SetCurrentNode(root)
+	tree.SetBorder(true).SetTitle(" Notebooks ")
+	tree.SetSelectedFunc(func(node *tview.TreeNode) {
+		lv := pocket.ListPage.ListView
+		lv.notebook = node.GetReference().(string)
+		lv.nbc.SetText(NotebookSep + lv.notebook)
+		lv.pageNum = 1
+		lv.page.SetText("1")
+		UIFetchNotes(pocket, 0)
+	})
+	tree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyESC || event.Rune() == 'q' || event.Rune() == 'h' || event.Key() == tcell.KeyLeft {
+			pocket.SetFocus(pocket.ListPage.Options)
+			return nil
+		}
+		if event.Rune() == 'l' || event.Key() == tcell.KeyRight {
+			pocket.ListPage.FocusOne(pocket)
+			return nil
+		}
+		return event
+	})
+	return tree
+}
+
+// Rebuild the notebook tree, the selected notebook is always displayed even if it's empty.
+func SetNotebookTree(tree *tview.TreeView, notebooks []string, selected string) {
+	root := tree.GetRoot()
+	root.ClearChildren()
+	current := root
+	nodes := map[string]*tview.TreeNode{"": root}
+	for _, nb := range ExpandNotebooks(append(notebooks, selected)) {
+		parent := nodes[ParentNotebook(nb)]
+		node := tview.NewTreeNode(nb[strings.LastIndex(nb, NotebookSep)+1:]).SetReference(nb)
+		parent.AddChild(node)
+		nodes[nb] = node
+		if nb == selected {
+			current = node
+		}
+	}
+	tree.SetCurrentNode(current)
+}
+
 type DetailView struct {
 	flex *tview.Flex
 
-	bar     *tview.TextView
-	id      *tview.TableCell
-	name    *tview.TableCell
-	ctime   *tview.TableCell
-	utime   *tview.TableCell
-	desc    *tview.TableCell
-	content *tview.TextView
-
-	Item   Note
-	Masked bool
+	bar      *tview.TextView
+	id       *tview.TableCell
+	name     *tview.TableCell
+	ctime    *tview.TableCell
+	utime    *tview.TableCell
+	desc     *tview.TableCell
+	tags     *tview.TableCell
+	notebook *tview.TableCell
+	files    *tview.TableCell
+	content  *tview.TextView
+	info     *tview.Table
+	top      *tview.Flex
+	totp     *tview.TextView
+
+	totpStop chan struct{} // stops refreshing TOTP code of the previous note
+
+	pocket       *Pocket
+	Item         Note
+	Attachments  []Attachment
+	Masked       bool
+	FieldsMasked []bool
 }
 
+// Rows of fields are appended to the Info table after the fixed rows.
+const detailFieldRow = 8
+
 func (d *DetailView) MaskNote() {
 	d.Masked = false
 	d.SwitchMasking()
@@ -469,23 +675,215 @@ func (d *DetailView) SwitchMasking() {
 	d.Masked = !d.Masked
 }
 
+// Clear the displayed note, e.g., when the vault is locked.
+func (d *DetailView) Clear() {
+	d.StopTOTP()
+	for _, c := range []*tview.TableCell{d.id, d.name, d.desc, d.tags, d.notebook, d.files, d.ctime, d.utime} {
+		c.SetText("")
+	}
+	d.content.SetText("")
+	d.bar.SetText(" ")
+	d.Item = Note{}
+	d.Attachments = nil
+	d.FieldsMasked = nil
+	d.renderFields()
+	d.flex.ResizeItem(d.totp, 0, 0)
+}
+
 func (d *DetailView) Display(nt Note) {
 	Debugf("Display %#v", nt)
 	d.id.SetText(cast.ToString(nt.Id))
 	d.name.SetText(nt.Name)
 	d.desc.SetText(nt.Desc)
+	d.tags.SetText(FormatTags(nt.Tags))
+	d.notebook.SetText(NotebookSep + nt.Notebook)
 	d.content.SetText(nt.Content)
 	d.ctime.SetText(nt.Ctime.FormatClassic())
 	d.utime.SetText(nt.Utime.FormatClassic())
 	d.Item = nt
 
 	d.MaskNote()
+
+	d.FieldsMasked = make([]bool, len(nt.Fields))
+	for i, f := range nt.Fields {
+		d.FieldsMasked[i] = f.Secret
+	}
+	d.renderFields()
+	d.displayTOTP(nt)
+
+	d.files.SetText("")
+	d.Attachments = nil
+	go func() {
+		atts, err := d.pocket.Storage.FetchAttachments(nt.Id)
+		if err != nil {
+			Debugf("Failed to fetch attachments of note %v, %v", nt.Id, err)
+			return
+		}
+		d.pocket.QueueUpdateDraw(func() {
+			if d.Item.Id != nt.Id {
+				return
+			}
+			names := make([]string, 0, len(atts))
+			for _, a := range atts {
+				names = append(names, a.Name)
+			}
+			d.files.SetText(strings.Join(names, ", "))
+			d.Attachments = atts
+		})
+	}()
+}
+
+func (d *DetailView) renderFields() {
+	for d.info.GetRowCount() > detailFieldRow {
+		d.info.RemoveRow(d.info.GetRowCount() - 1)
+	}
+	for i, f := range d.Item.Fields {
+		r := detailFieldRow + i
+		d.info.SetCell(r, 1, tview.NewTableCell(f.Name+":").SetAlign(tview.AlignRight))
+		v := f.Value
+		if d.FieldsMasked[i] {
+			v = strings.Repeat("*", len([]rune(v)))
+		}
+		d.info.SetCell(r, 2, tview.NewTableCell(tview.Escape(v)))
+		d.info.SetCell(r, 3, tview.NewTableCell("("+f.Type+")").SetTextColor(tcell.ColorGray))
+	}
+	d.flex.ResizeItem(d.top, detailFieldRow+5+len(d.Item.Fields), 1)
+}
+
+// Focus the Info table to select fields, returns false if the note has no field.
+func (d *DetailView) FocusFields() bool {
+	if len(d.Item.Fields) < 1 {
+		return false
+	}
+	d.info.SetSelectable(true, false)
+	d.info.Select(detailFieldRow, 0)
+	d.pocket.SetFocus(d.info)
+	return true
+}
+
+// Index of the selected field, returns false if no field is selected.
+func (d *DetailView) SelectedField() (int, bool) {
+	r, _ := d.info.GetSelection()
+	i := r - detailFieldRow
+	if i < 0 || i >= len(d.Item.Fields) {
+		return 0, false
+	}
+	return i, true
+}
+
+func (d *DetailView) SwitchFieldMasking(i int) {
+	d.FieldsMasked[i] = !d.FieldsMasked[i]
+	d.renderFields()
+}
+
+// Copy value of the field, current code is copied for totp field.
+func (d *DetailView) CopyField(i int) {
+	f := d.Item.Fields[i]
+	if f.Type == FieldTOTP {
+		if t, err := ParseTOTP(f.Value); err == nil {
+			d.copy(f.Name+" code", t.Code(time.Now()))
+			return
+		}
+	}
+	d.copy(f.Name, f.Value)
+}
+
+// Stop refreshing the TOTP code, e.g., when leaving the detail page.
+func (d *DetailView) StopTOTP() {
+	if d.totpStop != nil {
+		close(d.totpStop)
+		d.totpStop = nil
+	}
+}
+
+// Display the live TOTP code of the note with a countdown bar, the panel is hidden if the note doesn't have TOTP.
+func (d *DetailView) displayTOTP(nt Note) {
+	d.StopTOTP()
+	t, err := NoteTOTP(nt)
+	if err != nil {
+		d.totp.SetText("")
+		d.flex.ResizeItem(d.totp, 0, 0)
+		if err != ErrNoTotp {
+			d.totp.SetText(fmt.Sprintf("[red]%v", tview.Escape(err.Error())))
+			d.flex.ResizeItem(d.totp, 3, 0)
+		}
+		return
+	}
+
+	render := func() {
+		now := time.Now()
+		code := t.Code(now)
+		if len(code) > 4 {
+			code = code[:len(code)/2] + " " + code[len(code)/2:]
+		}
+		remaining := t.Remaining(now)
+		const width = 30
+		filled := int(remaining) * width / (t.Period * int(time.Second))
+		color := "green"
+		if remaining <= 5*time.Second {
+			color = "red"
+		}
+		d.totp.SetText(fmt.Sprintf("[::b]%v[::-]  [%v]%v[gray]%v[-]  %2ds", code, color, strings.Repeat("█", filled),
+			strings.Repeat("░", width-filled), int(remaining.Seconds()+0.5)))
+	}
+	render()
+	d.flex.ResizeItem(d.totp, 3, 0)
+
+	stop := make(chan struct{})
+	d.totpStop = stop
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.pocket.QueueUpdateDraw(func() {
+					select {
+					case <-stop:
+					default:
+						render()
+					}
+				})
+			}
+		}
+	}()
+}
+
+func (d *DetailView) CopyContent() {
+	d.copy("content", d.Item.Content)
+}
+
+// Copy the value to clipboard, countdown of the auto-clear is displayed in the top bar.
+func (d *DetailView) copy(name string, value string) {
+	status := func(remaining time.Duration, cleared bool) {
+		switch {
+		case _clipTimeout <= 0:
+			d.bar.SetText(fmt.Sprintf("Copied %v", name))
+		case remaining > 0:
+			d.bar.SetText(fmt.Sprintf("Copied %v, clipboard will be cleared in %v", name, remaining.Round(time.Second)))
+		case cleared:
+			d.bar.SetText("Clipboard cleared")
+		default:
+			d.bar.SetText(" ")
+		}
+	}
+	err := CopyToClipboard(value, _clipTimeout, func(remaining time.Duration, cleared bool) {
+		d.pocket.QueueUpdateDraw(func() { status(remaining, cleared) })
+	})
+	if err != nil {
+		PopMsg(d.pocket, nil, "failed to copy %v, %v", name, err)
+		return
+	}
+	status(_clipTimeout, false)
 }
 
 func NewDetailView(pocket *Pocket) (iv *DetailView) {
 	topFlex := tview.NewFlex().SetDirection(tview.FlexRow)
 
 	iv = new(DetailView)
+	iv.pocket = pocket
 	iv.bar = tview.NewTextView()
 	iv.bar.SetBorder(true)
 	iv.bar.SetText(" ")
@@ -525,6 +923,64 @@ func NewDetailView(pocket *Pocket) (iv *DetailView) {
 	iv.desc = tview.NewTableCell("")
 	tb.SetCell(r, 2, iv.desc)
 
+	r += 1
+	tb.SetCellSimple(r, 1, "Tags:")
+	tb.GetCell(r, 1).SetAlign(tview.AlignRight)
+	iv.tags = tview.NewTableCell("")
+	tb.SetCell(r, 2, iv.tags)
+
+	r += 1
+	tb.SetCellSimple(r, 1, "Notebook:")
+	tb.GetCell(r, 1).SetAlign(tview.AlignRight)
+	iv.notebook = tview.NewTableCell("")
+	tb.SetCell(r, 2, iv.notebook)
+
+	r += 1
+	tb.SetCellSimple(r, 1, "Files:")
+	tb.GetCell(r, 1).SetAlign(tview.AlignRight)
+	iv.files = tview.NewTableCell("")
+	tb.SetCell(r, 2, iv.files)
+
+	for i := 0; i < tb.GetRowCount(); i++ {
+		for j := 0; j < tb.GetColumnCount(); j++ {
+			if c := tb.GetCell(i, j); c != nil {
+				c.SetSelectable(false)
+			}
+		}
+	}
+	tb.SetSelectedFunc(func(row, column int) {
+		if i, ok := iv.SelectedField(); ok {
+			iv.SwitchFieldMasking(i)
+		}
+	})
+	tb.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Rune() == 'h' || event.Rune() == 'q' || event.Key() == tcell.KeyESC || event.Key() == tcell.KeyLeft {
+			pocket.SetFocus(pocket.DetailPage.Options)
+			return nil
+		}
+		i, ok := iv.SelectedField()
+		if !ok {
+			return event
+		}
+		switch event.Rune() {
+		case 'm':
+			iv.SwitchFieldMasking(i)
+			return nil
+		case 'y':
+			iv.CopyField(i)
+			return nil
+		case 'e':
+			PopEditFieldPage(pocket, iv.Item, i)
+			return nil
+		case 'd':
+			PopDeleteFieldPage(pocket, iv.Item, i)
+			return nil
+		}
+		return event
+	})
+	tb.SetBlurFunc(func() { tb.SetSelectable(false, false) })
+	iv.info = tb
+
 	infp := tview.NewFlex().SetDirection(tview.FlexColumn).
 		AddItem(tb, 0, 1, false)
 
@@ -534,11 +990,16 @@ func NewDetailView(pocket *Pocket) (iv *DetailView) {
 	iv.content.SetBorder(true).SetTitle(" Content ")
 	iv.content.SetChangedFunc(func() { pocket.Draw() })
 
+	iv.totp = tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	iv.totp.SetBorder(true).SetTitle(" TOTP ")
+
 	mainFlex := tview.NewFlex().SetDirection(tview.FlexRow).
-		AddItem(topFlex, 10, 1, true).
+		AddItem(topFlex, detailFieldRow+5, 1, true).
+		AddItem(iv.totp, 0, 0, false).
 		AddItem(iv.content, 0, 1, false)
 
 	iv.flex = mainFlex
+	iv.top = topFlex
 
 	return iv
 }
@@ -547,11 +1008,14 @@ type ListView struct {
 	flex    *tview.Flex
 	bar     *tview.TextView  // top bar
 	name    *tview.TableCell // searched name
+	tags    *tview.TableCell // searched tags
+	nbc     *tview.TableCell // selected notebook
 	page    *tview.TableCell // at page (1-based)
 	total   *tview.TableCell // total
 	content *tview.Flex      // content of the list view, contains N note items
 
-	pageNum int
+	pageNum  int
+	notebook string // selected notebook, empty string is the root notebook
 }
 
 type ListItemPrimitive struct {
@@ -585,14 +1049,19 @@ func (l *ListView) AddNote(it Note) {
 	descc := tview.NewTableCell(it.Desc)
 	tb.SetCell(2, 1, descc)
 
-	tb.SetCellSimple(3, 0, "Updated At:")
+	tb.SetCellSimple(3, 0, "Tags:")
 	tb.GetCell(3, 0).SetAlign(tview.AlignRight)
+	tagsc := tview.NewTableCell(FormatTags(it.Tags))
+	tb.SetCell(3, 1, tagsc)
+
+	tb.SetCellSimple(4, 0, "Updated At:")
+	tb.GetCell(4, 0).SetAlign(tview.AlignRight)
 	utimec := tview.NewTableCell(it.Utime.FormatClassic())
-	tb.SetCell(3, 1, utimec)
+	tb.SetCell(4, 1, utimec)
 
 	lip.SetFocusFunc(func() { lip.SetBorderColor(tcell.ColorYellow) })
 	lip.SetBlurFunc(func() { lip.SetBorderColor(tcell.ColorWhite) })
-	l.content.AddItem(lip, 6, 1, false)
+	l.content.AddItem(lip, 7, 1, false)
 }
 
 func NewListView(pocket *Pocket, extendCap func(lv *ListView, event *tcell.EventKey) (*tcell.EventKey, bool)) (iv *ListView) {
@@ -614,15 +1083,25 @@ func NewListView(pocket *Pocket, extendCap func(lv *ListView, event *tcell.Event
 	iv.name = tview.NewTableCell("").SetTextColor(tview.Styles.SecondaryTextColor)
 	tb.SetCell(0, 2, iv.name)
 
-	tb.SetCellSimple(1, 1, "Page:")
+	tb.SetCellSimple(1, 1, "Tags:")
 	tb.GetCell(1, 1).SetAlign(tview.AlignRight)
-	iv.page = tview.NewTableCell("1").SetTextColor(tview.Styles.SecondaryTextColor)
-	tb.SetCell(1, 2, iv.page)
+	iv.tags = tview.NewTableCell("").SetTextColor(tview.Styles.SecondaryTextColor)
+	tb.SetCell(1, 2, iv.tags)
 
-	tb.SetCellSimple(2, 1, "Total:")
+	tb.SetCellSimple(2, 1, "Notebook:")
 	tb.GetCell(2, 1).SetAlign(tview.AlignRight)
+	iv.nbc = tview.NewTableCell(NotebookSep).SetTextColor(tview.Styles.SecondaryTextColor)
+	tb.SetCell(2, 2, iv.nbc)
+
+	tb.SetCellSimple(3, 1, "Page:")
+	tb.GetCell(3, 1).SetAlign(tview.AlignRight)
+	iv.page = tview.NewTableCell("1").SetTextColor(tview.Styles.SecondaryTextColor)
+	tb.SetCell(3, 2, iv.page)
+
+	tb.SetCellSimple(4, 1, "Total:")
+	tb.GetCell(4, 1).SetAlign(tview.AlignRight)
 	iv.total = tview.NewTableCell("0").SetTextColor(tview.Styles.SecondaryTextColor)
-	tb.SetCell(2, 2, iv.total)
+	tb.SetCell(4, 2, iv.total)
 
 	infp := tview.NewFlex().
 		SetDirection(tview.FlexColumn).
@@ -684,7 +1163,7 @@ func NewListView(pocket *Pocket, extendCap func(lv *ListView, event *tcell.Event
 	})
 
 	mainFlex := tview.NewFlex().SetDirection(tview.FlexRow).
-		AddItem(topFlex, 10, 1, true).
+		AddItem(topFlex, 11, 1, true).
 		AddItem(iv.content, 0, 1, false)
 
 	iv.flex = mainFlex
@@ -749,6 +1228,78 @@ func NewForm(vimBased bool) *tview.Form {
 	return form
 }
 
+// Press 'g' in the vim-based form to insert generated password at the cursor of the focused text area.
+func bindGenerator(pocket *Pocket, form *tview.Form) {
+	capture := form.GetInputCapture()
+	form.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if ev.Rune() == 'g' {
+			if ta, _, ok := FindFocusedTextArea(form); ok {
+				PopGeneratorPage(pocket, func(s string) {
+					_, start, end := ta.GetSelection()
+					ta.Replace(start, end, s)
+				})
+				return nil
+			}
+		}
+		if capture != nil {
+			return capture(ev)
+		}
+		return ev
+	})
+}
+
+// Popup of the password generator, onInsert is called with the generated password or passphrase.
+func PopGeneratorPage(pocket *Pocket, onInsert func(s string)) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageGen) }
+
+	po := DefaultPasswordOptions()
+	pp := PassphraseOptions{Words: DefaultPassphraseWords, Separator: "-"}
+	passphrase := false
+	value := ""
+	result := tview.NewTextView().SetLabel("Result:").SetSize(1, 70)
+	generate := func() {
+		var err error
+		if passphrase {
+			value, err = GeneratePassphrase(pp)
+		} else {
+			value, err = GeneratePassword(po)
+		}
+		if err != nil {
+			value = ""
+			result.SetText(err.Error())
+			return
+		}
+		result.SetText(value)
+	}
+
+	form.AddDropDown("Type:", []string{"Password", "Passphrase"}, 0, func(_ string, i int) { passphrase = i == 1; generate() })
+	form.AddInputField("Length:", cast.ToString(po.Length), 10, tview.InputFieldInteger, func(t string) { po.Length = cast.ToInt(t); generate() })
+	form.AddCheckbox("Lowercase:", po.Lower, func(c bool) { po.Lower = c; generate() })
+	form.AddCheckbox("Uppercase:", po.Upper, func(c bool) { po.Upper = c; generate() })
+	form.AddCheckbox("Digits:", po.Digits, func(c bool) { po.Digits = c; generate() })
+	form.AddCheckbox("Symbols:", po.Symbols, func(c bool) { po.Symbols = c; generate() })
+	form.AddCheckbox("No Ambiguous:", po.ExcludeAmbiguous, func(c bool) { po.ExcludeAmbiguous = c; generate() })
+	form.AddInputField("Words:", cast.ToString(pp.Words), 10, tview.InputFieldInteger, func(t string) { pp.Words = cast.ToInt(t); generate() })
+	form.AddFormItem(result)
+	generate()
+
+	form.AddButton("Insert", func() {
+		if value != "" {
+			close()
+			onInsert(value)
+		}
+	})
+	form.AddButton("Regenerate", generate)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Generate Password ")
+
+	popup := createPopup(form, 23, 90)
+	pocket.Pages.AddPage(PageGen, popup, true, true)
+}
+
 func FindFocusedTextArea(form *tview.Form) (*tview.TextArea, int, bool) {
 	i, _ := form.GetFocusedItemIndex()
 	if i > -1 {
@@ -763,6 +1314,7 @@ func PopDeleteNotePage(pocket *Pocket, it Note) {
 	form := NewForm(false)
 	close := func() { pocket.RemovePage(PageDelete) }
 	confirm := func() {
+		pocket.DetailPage.StopTOTP()
 		UIDeleteNote(pocket, it, func(err error) {
 			pocket.ToPage(PageList)
 			if err == nil {
@@ -771,7 +1323,7 @@ func PopDeleteNotePage(pocket *Pocket, it Note) {
 		})
 		close()
 	}
-	form.AddTextView("", fmt.Sprintf("Deleting %v", it.Name), 40, 5, false, true)
+	form.AddTextView("", fmt.Sprintf("Moving %v to trash", it.Name), 40, 5, false, true)
 	form.AddButton("Confirm", confirm)
 	form.SetCancelFunc(close)
 	form.SetButtonsAlign(tview.AlignCenter)
@@ -781,112 +1333,1025 @@ func PopDeleteNotePage(pocket *Pocket, it Note) {
 	pocket.Pages.AddPage(PageDelete, popup, true, true)
 }
 
-func UIDeleteNote(pocket *Pocket, nt Note, callback func(err error)) {
-	go func() {
-		err := StDeleteNote(nt)
-		callback(err)
-	}()
-}
-
-func UIEditNote(pocket *Pocket, note Note, callback func(err error)) {
-	go func() {
-		err := StEditNote(note)
-		callback(err)
-	}()
-}
+func PopMoveNotePage(pocket *Pocket, it Note) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageMove) }
 
-func UICreateNote(pocket *Pocket, note Note, callback func(note Note, err error)) {
-	go func() {
-		note, err := StCreateNote(note)
-		callback(note, err)
-	}()
-}
+	var notebooks []string
+	if nbs, err := pocket.Storage.ListNotebooks(); err == nil {
+		notebooks = ExpandNotebooks(nbs)
+	}
 
-func UIFetchNotes(pocket *Pocket, pageDelta int, then ...func()) {
-	name := pocket.ListPage.name.Text
-	page := pocket.ListPage.pageNum
-	page += pageDelta
+	notebook := it.Notebook
+	form.AddInputField(LabelNotebook, notebook, 60, nil, func(t string) { notebook = t })
+	nf := form.GetFormItemByLabel(LabelNotebook).(*tview.InputField)
+	nf.SetAutocompleteFunc(func(t string) []string {
+		matched := []string{}
+		for _, nb := range notebooks {
+			if t != "" && strings.HasPrefix(nb, t) {
+				matched = append(matched, nb)
+			}
+		}
+		return matched
+	})
 
-	go func() {
-		total, items, err := StFetchNotes(page, PageLimit, name)
-		if err == nil {
+	confirm := func() {
+		UIMoveNote(pocket, it, notebook, func(err error) {
 			pocket.QueueUpdateDraw(func() {
-				pocket.ListPage.total.SetText(cast.ToString(total))
+				if err != nil {
+					PopMsg(pocket, nil, "failed to move note, %v", err)
+					return
+				}
+				close()
+				it.Notebook = NormalizeNotebook(notebook)
+				pocket.DetailPage.Display(it)
+			})
+		})
+	}
 
-				prev := pocket.ListPage.pageNum
-				if prev != page {
-					if page > prev && len(items) < 1 { // displyaing next page, but the page is empty
-						return
-					}
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(fmt.Sprintf(" Move %v (e.g., infra/prod) ", it.Name))
 
-					pocket.ListPage.pageNum = page
-					pocket.ListPage.page.SetText(cast.ToString(page))
-				}
-				pocket.ListPage.ClearNotes()
-				for _, it := range items {
-					pocket.ListPage.AddNote(it)
-				}
+	popup := createPopup(form, 7, 80)
+	pocket.Pages.AddPage(PageMove, popup, true, true)
+}
 
-				for _, th := range then {
-					th()
-				}
-			})
-		}
+func PopHistoryPage(pocket *Pocket, it Note) {
+	go func() {
+		revs, err := pocket.Storage.FetchRevisions(it.Id)
+		pocket.QueueUpdateDraw(func() {
+			if err != nil {
+				PopMsg(pocket, nil, "failed to load revisions, %v", err)
+				return
+			}
+			if len(revs) < 1 {
+				PopMsg(pocket, nil, "%v has no revisions", it.Name)
+				return
+			}
+			popHistoryPage(pocket, it, revs)
+		})
 	}()
 }
 
-func PopPasswordPage(pocket *Pocket) {
-	form := NewForm(false)
+// Revisions are listed with the current version at the top, select two of them to diff, or restore one of them.
+func popHistoryPage(pocket *Pocket, it Note, revs []Revision) {
+	close := func() { pocket.RemovePage(PageHistory) }
 
-	var tmppw string = ""
-	form.AddPasswordField("Password (8-32 english characters [0-9a-zA-Z-_!.]):", tmppw, 32, '*',
-		func(t string) { tmppw = t })
+	// versions[0] is the current version, the rest are revisions, latest first
+	versions := append([]Revision{{NoteId: it.Id, Name: it.Name, Desc: it.Desc, Content: it.Content, Fields: it.Fields, Utime: it.Utime}}, revs...)
+	title := func(i int) string {
+		if i == 0 {
+			return "Current"
+		}
+		return fmt.Sprintf("Revision #%v", versions[i].Id)
+	}
+	// values of secret fields are masked
+	format := func(r Revision) string {
+		sb := strings.Builder{}
+		sb.WriteString(fmt.Sprintf("Name: %v\nDescription: %v\n", r.Name, r.Desc))
+		for _, f := range r.Fields {
+			v := f.Value
+			if f.Secret {
+				v = strings.Repeat("*", len([]rune(v)))
+			}
+			sb.WriteString(fmt.Sprintf("%v (%v): %v\n", f.Name, f.Type, v))
+		}
+		sb.WriteString("\n" + r.Content)
+		return sb.String()
+	}
 
-	ni := form.GetFormItem(0).(*tview.InputField)
-	resetPasswordField := func(msg string) {
-		ni.SetText("")
-		PopMsg(pocket, func() { pocket.SetFocus(ni) }, msg)
+	preview := tview.NewTextView().SetDynamicColors(true)
+	preview.SetBorder(true).SetTitle(" Preview ")
+
+	list := tview.NewList()
+	list.SetBorder(true).SetTitle(" History ")
+	for i, v := range versions {
+		list.AddItem(title(i), "Updated At "+v.Utime.FormatClassic(), 0, nil)
 	}
 
-	ni.SetInputCapture(func(e *tcell.EventKey) *tcell.EventKey {
+	help := tview.NewTextView().SetTextAlign(tview.AlignCenter).
+		SetText("Enter: view, Space: mark, d: diff with marked (or current), r: restore, q: close")
 
-		if e.Key() == tcell.KeyEnter {
-			if err := ValidatePassword(tmppw); err != nil {
-				resetPasswordField(err.Error())
-				return nil
+	marked := -1
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		i := list.GetCurrentItem()
+		switch {
+		case event.Rune() == 'j':
+			return KeyDownEvt
+		case event.Rune() == 'k':
+			return KeyUpEvt
+		case event.Rune() == 'q' || event.Key() == tcell.KeyESC:
+			close()
+			return nil
+		case event.Key() == tcell.KeyEnter:
+			preview.SetTitle(fmt.Sprintf(" %v ", title(i)))
+			preview.SetText(tview.Escape(format(versions[i]))).ScrollToBeginning()
+			return nil
+		case event.Rune() == ' ':
+			if marked > -1 {
+				list.SetItemText(marked, title(marked), "Updated At "+versions[marked].Utime.FormatClassic())
 			}
-			InitPassword(tmppw)
-			ok, err := StCheckPassword()
-			if err != nil {
-				resetPasswordField(err.Error())
+			if marked == i {
+				marked = -1
 				return nil
 			}
-			if !ok {
-				resetPasswordField("password incorrect")
+			marked = i
+			list.SetItemText(i, title(i)+" (marked)", "Updated At "+versions[i].Utime.FormatClassic())
+			return nil
+		case event.Rune() == 'd':
+			other := marked
+			if other < 0 {
+				other = 0
+			}
+			if other == i {
 				return nil
 			}
-
-			if err := StInitSchema(); err != nil {
-				PopMsg(pocket, nil, err.Error())
+			older, newer := i, other // larger index is older
+			if older < newer {
+				older, newer = newer, older
+			}
+			sb := strings.Builder{}
+			for _, l := range DiffLines(format(versions[older]), format(versions[newer])) {
+				line := tview.Escape(string(l.Op) + " " + l.Text)
+				switch l.Op {
+				case DiffInsert:
+					line = "[green]" + line + "[-]"
+				case DiffDelete:
+					line = "[red]" + line + "[-]"
+				}
+				sb.WriteString(line + "\n")
+			}
+			preview.SetTitle(fmt.Sprintf(" %v -> %v ", title(older), title(newer)))
+			preview.SetText(sb.String()).ScrollToBeginning()
+			return nil
+		case event.Rune() == 'r':
+			if i == 0 {
 				return nil
 			}
-			pocket.RemovePage(PagePassword)
-			pocket.ToPage(PageList)
-			UIFetchNotes(pocket, 0)
+			// current version is recorded as a new revision, so restoring is always reversible
+			rev := versions[i]
+			go func() {
+				n, err := pocket.Storage.RestoreRevision(it.Id, rev.Id)
+				pocket.QueueUpdateDraw(func() {
+					if err != nil {
+						PopMsg(pocket, nil, "failed to restore revision, %v", err)
+						return
+					}
+					close()
+					pocket.DetailPage.Display(n)
+				})
+			}()
+			return nil
+		}
+		return event
+	})
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
+			AddItem(list, 40, 1, true).
+			AddItem(preview, 0, 1, false), 0, 1, true).
+		AddItem(help, 1, 1, false)
+
+	popup := createPopup(flex, 35, 140)
+	pocket.Pages.AddPage(PageHistory, popup, true, true)
+}
+
+func PopTrashPage(pocket *Pocket) {
+	go func() {
+		trashed, err := pocket.Storage.FetchTrash()
+		if err != nil {
+			pocket.QueueUpdateDraw(func() { PopMsg(pocket, nil, "failed to load trash, %v", err) })
+			return
+		}
+		days, err := pocket.Storage.TrashRetention()
+		pocket.QueueUpdateDraw(func() {
+			if err != nil {
+				PopMsg(pocket, nil, "failed to load trash, %v", err)
+				return
+			}
+			popTrashPage(pocket, trashed, days)
+		})
+	}()
+}
+
+func popTrashPage(pocket *Pocket, trashed []TrashedNote, days int) {
+	close := func() { pocket.RemovePage(PageTrash) }
+
+	// run the action, then reload the trash page and the list page
+	update := func(action func() error) {
+		go func() {
+			err := action()
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "%v", err)
+					return
+				}
+				close()
+				PopTrashPage(pocket)
+				UIFetchNotes(pocket, 0)
+			})
+		}()
+	}
+
+	preview := tview.NewTextView()
+	preview.SetBorder(true).SetTitle(" Preview ")
+
+	list := tview.NewList()
+	title := " Trash (empty) "
+	if len(trashed) > 0 {
+		title = fmt.Sprintf(" Trash (%d) ", len(trashed))
+	}
+	list.SetBorder(true).SetTitle(title)
+	for _, n := range trashed {
+		list.AddItem(n.Name, "Deleted At "+n.Dtime.FormatClassic(), 0, nil)
+	}
+	showNote := func(i int) {
+		n := trashed[i]
+		preview.SetText(fmt.Sprintf("Name: %v\nDescription: %v\nNotebook: %v\nTags: %v", n.Name, n.Desc,
+			NotebookSep+n.Notebook, FormatTags(n.Tags)))
+	}
+	list.SetChangedFunc(func(i int, _ string, _ string, _ rune) { showNote(i) })
+	if len(trashed) > 0 {
+		showNote(0)
+	}
+
+	retention := "never purged automatically"
+	if days > 0 {
+		retention = fmt.Sprintf("purged after %d days", days)
+	}
+	help := tview.NewTextView().SetTextAlign(tview.AlignCenter).
+		SetText(fmt.Sprintf("r: restore, P: purge, E: empty trash, D: retention (%v), q: close", retention))
+
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case event.Rune() == 'j':
+			return KeyDownEvt
+		case event.Rune() == 'k':
+			return KeyUpEvt
+		case event.Rune() == 'q' || event.Key() == tcell.KeyESC:
+			close()
+			return nil
+		case event.Rune() == 'D':
+			PopTrashRetentionPage(pocket, days, func() {
+				close()
+				PopTrashPage(pocket)
+			})
+			return nil
+		}
+		if len(trashed) < 1 {
+			return event
+		}
+
+		n := trashed[list.GetCurrentItem()]
+		switch event.Rune() {
+		case 'r':
+			update(func() error { return pocket.Storage.RestoreNote(n.Id) })
+			return nil
+		case 'P':
+			PopConfirmDialog(pocket, func() {
+				pocket.RemovePage(PageConfirm)
+				update(func() error { return pocket.Storage.PurgeNote(n.Id) })
+			}, fmt.Sprintf("Permanently delete %v?", n.Name), 50, 15)
+			return nil
+		case 'E':
+			PopConfirmDialog(pocket, func() {
+				pocket.RemovePage(PageConfirm)
+				update(func() error {
+					_, err := pocket.Storage.PurgeTrash(0)
+					return err
+				})
+			}, fmt.Sprintf("Permanently delete all %d notes in trash?", len(trashed)), 50, 15)
+			return nil
+		}
+		return event
+	})
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
+			AddItem(list, 50, 1, true).
+			AddItem(preview, 0, 1, false), 0, 1, true).
+		AddItem(help, 1, 1, false)
+
+	popup := createPopup(flex, 30, 120)
+	pocket.Pages.AddPage(PageTrash, popup, true, true)
+}
+
+// Set the external editor persisted in vault, it's used unless -editor flag is specified.
+func PopEditorPage(pocket *Pocket) {
+	input, err := pocket.Storage.Editor()
+	if err != nil {
+		PopMsg(pocket, nil, "failed to load editor, %v", err)
+		return
+	}
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageEditor) }
+
+	form.AddInputField("Editor (empty for $VISUAL/$EDITOR):", input, 30, nil, func(t string) { input = t })
+	confirm := func() {
+		go func() {
+			err := pocket.Storage.SetEditor(input)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "%v", err)
+					return
+				}
+				close()
+				if _editor != "" {
+					PopMsg(pocket, nil, "Editor saved, but '%v' specified by -editor flag is used for now", _editor)
+				}
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Editor ")
+
+	popup := createPopup(form, 7, 70)
+	pocket.Pages.AddPage(PageEditor, popup, true, true)
+}
+
+func PopTrashRetentionPage(pocket *Pocket, days int, onUpdated func()) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageTrashCfg) }
+
+	input := cast.ToString(days)
+	form.AddInputField("Days (0 to keep forever):", input, 10, tview.InputFieldInteger, func(t string) { input = t })
+	confirm := func() {
+		n, err := cast.ToIntE(input)
+		if err != nil || n < 0 {
+			PopMsg(pocket, nil, "invalid number of days '%v'", input)
+			return
+		}
+		go func() {
+			err := pocket.Storage.SetTrashRetention(n)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "%v", err)
+					return
+				}
+				close()
+				onUpdated()
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Trash Retention ")
+
+	popup := createPopup(form, 7, 50)
+	pocket.Pages.AddPage(PageTrashCfg, popup, true, true)
+}
+
+func PopAttachFilePage(pocket *Pocket, it Note) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageAttach) }
+
+	var file string
+	form.AddInputField("File:", "", 60, nil, func(t string) { file = strings.TrimSpace(t) })
+	confirm := func() {
+		name, data, err := ReadAttachmentFile(file)
+		if err != nil {
+			PopMsg(pocket, nil, "failed to read file, %v", err)
+			return
+		}
+		go func() {
+			_, err := pocket.Storage.AddAttachment(it.Id, name, data)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "failed to attach file, %v", err)
+					return
+				}
+				close()
+				pocket.DetailPage.Display(it)
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(fmt.Sprintf(" Attach File (max %v MB) ", MaxAttachmentSize/1024/1024))
+
+	popup := createPopup(form, 7, 80)
+	pocket.Pages.AddPage(PageAttach, popup, true, true)
+}
+
+func newAttachmentDropDown(form *tview.Form, atts []Attachment, selected *int) {
+	options := make([]string, 0, len(atts))
+	for _, a := range atts {
+		options = append(options, fmt.Sprintf("%v (%v bytes)", a.Name, a.Size))
+	}
+	form.AddDropDown("Attachment:", options, 0, func(_ string, i int) { *selected = i })
+}
+
+// Extract the attachment to a file with 0600 permission.
+func PopExtractFilePage(pocket *Pocket, atts []Attachment) {
+	if len(atts) < 1 {
+		PopMsg(pocket, nil, "Note has no attachment")
+		return
+	}
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageAttach) }
+
+	selected := 0
+	newAttachmentDropDown(form, atts, &selected)
+	path, _ := os.UserHomeDir()
+	form.AddInputField("Save To:", path, 60, nil, func(t string) { path = strings.TrimSpace(t) })
+	confirm := func() {
+		id := atts[selected].Id
+		go func() {
+			a, err := pocket.Storage.FetchAttachment(id)
+			if err == nil {
+				path, err = WriteAttachmentFile(a, path)
+			}
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "failed to extract file, %v", err)
+					return
+				}
+				close()
+				PopMsg(pocket, nil, "Saved to %v", path)
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Extract File ")
+
+	popup := createPopup(form, 9, 80)
+	pocket.Pages.AddPage(PageAttach, popup, true, true)
+}
+
+func PopDeleteFilePage(pocket *Pocket, it Note, atts []Attachment) {
+	if len(atts) < 1 {
+		PopMsg(pocket, nil, "Note has no attachment")
+		return
+	}
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageAttach) }
+
+	selected := 0
+	newAttachmentDropDown(form, atts, &selected)
+	confirm := func() {
+		id := atts[selected].Id
+		go func() {
+			err := pocket.Storage.DeleteAttachment(id)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "failed to delete file, %v", err)
+					return
+				}
+				close()
+				pocket.DetailPage.Display(it)
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Delete File ")
+
+	popup := createPopup(form, 7, 80)
+	pocket.Pages.AddPage(PageAttach, popup, true, true)
+}
+
+// Add field to the note (when i is -1) or edit the i-th field.
+func PopEditFieldPage(pocket *Pocket, it Note, i int) {
+	f := NoteField{Type: FieldText}
+	if i > -1 {
+		f = it.Fields[i]
+	}
+	popEditFieldPage(pocket, it, i, f)
+}
+
+func popEditFieldPage(pocket *Pocket, it Note, i int, f NoteField) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageField) }
+
+	title := " Add Field "
+	if i > -1 {
+		title = " Edit Field "
+	}
+
+	typ := 0
+	for j, t := range FieldTypes {
+		if t == f.Type {
+			typ = j
+		}
+	}
+	vi := tview.NewInputField().SetLabel("Value:").SetText(f.Value).SetFieldWidth(60).
+		SetChangedFunc(func(t string) { f.Value = t })
+	vi.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyCtrlG {
+			// InputField.SetText doesn't replace non-empty text, so the popup is re-created with the generated value
+			PopGeneratorPage(pocket, func(s string) {
+				f.Value = s
+				close()
+				popEditFieldPage(pocket, it, i, f)
+			})
+			return nil
+		}
+		return event
+	})
+	setSecret := func(secret bool) {
+		f.Secret = secret
+		if secret {
+			vi.SetMaskCharacter('*')
+		} else {
+			vi.SetMaskCharacter(0)
+		}
+	}
+	si := tview.NewCheckbox().SetLabel("Secret:").SetChecked(f.Secret).SetChangedFunc(setSecret)
+	di := tview.NewDropDown().SetLabel("Type:").SetOptions(FieldTypes, nil).SetCurrentOption(typ)
+	di.SetSelectedFunc(func(t string, _ int) {
+		// new fields are secret by default if the type is
+		if i < 0 && t != f.Type {
+			si.SetChecked(IsSecretFieldType(t))
+			setSecret(IsSecretFieldType(t))
+		}
+		f.Type = t
+	})
+	setSecret(f.Secret)
+
+	form.AddInputField("Name:", f.Name, 60, nil, func(t string) { f.Name = strings.TrimSpace(t) })
+	form.AddFormItem(di)
+	form.AddFormItem(vi)
+	form.AddFormItem(si)
+
+	confirm := func() {
+		n := it
+		n.Fields = append([]NoteField{}, it.Fields...)
+		if i > -1 {
+			n.Fields[i] = f
+		} else {
+			n.Fields = append(n.Fields, f)
+		}
+		if err := ValidateFields(n.Fields); err != nil {
+			PopMsg(pocket, nil, "%v", err)
+			return
+		}
+		n.Utime = Now()
+		UIEditNote(pocket, n, func(err error) {
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "failed to save field, %v", err)
+					return
+				}
+				close()
+				pocket.DetailPage.Display(n)
+			})
+		})
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(title + "(Ctrl-G to generate value) ")
+
+	popup := createPopup(form, 13, 80)
+	pocket.Pages.AddPage(PageField, popup, true, true)
+}
+
+func PopDeleteFieldPage(pocket *Pocket, it Note, i int) {
+	PopConfirmDialog(pocket, func() {
+		pocket.RemovePage(PageConfirm)
+		n := it
+		n.Fields = append(append([]NoteField{}, it.Fields[:i]...), it.Fields[i+1:]...)
+		n.Utime = Now()
+		UIEditNote(pocket, n, func(err error) {
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, "failed to delete field, %v", err)
+					return
+				}
+				pocket.DetailPage.Display(n)
+				pocket.DetailPage.FocusFields()
+			})
+		})
+	}, fmt.Sprintf("Delete field %v?", it.Fields[i].Name), 50, 15)
+}
+
+func UIDeleteNote(pocket *Pocket, nt Note, callback func(err error)) {
+	go func() {
+		err := pocket.Storage.DeleteNote(nt)
+		callback(err)
+	}()
+}
+
+func UIEditNote(pocket *Pocket, note Note, callback func(err error)) {
+	go func() {
+		err := pocket.Storage.UpdateNote(note)
+		callback(err)
+	}()
+}
+
+func UICreateNote(pocket *Pocket, note Note, callback func(note Note, err error)) {
+	go func() {
+		note, err := pocket.Storage.CreateNote(note)
+		callback(note, err)
+	}()
+}
+
+func UIMoveNote(pocket *Pocket, note Note, notebook string, callback func(err error)) {
+	go func() {
+		err := pocket.Storage.MoveNote(note.Id, notebook)
+		callback(err)
+	}()
+}
+
+// Wipe the key, clear the displayed notes and ask for the password again.
+func UILockVault(pocket *Pocket) {
+	if pocket.locked.Swap(true) {
+		return
+	}
+	pocket.Storage.LockVault()
+	ClearClipboard()
+
+	for _, p := range popupPages {
+		pocket.RemovePage(p)
+	}
+	pocket.DetailPage.DetailView.Clear()
+	pocket.ListPage.ClearNotes()
+	pocket.ListPage.total.SetText("")
+	SetNotebookTree(pocket.ListPage.Notebooks, nil, "")
+	pocket.ToPage(PageList)
+	clearPasswordField(pocket)
+	PopPasswordPage(pocket)
+}
+
+func UIFetchNotes(pocket *Pocket, pageDelta int, then ...func()) {
+	name := pocket.ListPage.name.Text
+	tags := ParseTags(pocket.ListPage.tags.Text)
+	notebook := pocket.ListPage.notebook
+	page := pocket.ListPage.pageNum
+	page += pageDelta
+
+	go func() {
+		q := NoteQuery{Page: page, Limit: PageLimit, Keyword: name, Tags: tags, Notebook: notebook}
+		total, items, err := pocket.Storage.FetchNotes(q)
+		var notebooks []string
+		if err == nil {
+			notebooks, err = pocket.Storage.ListNotebooks()
+		}
+		if err != nil {
+			pocket.QueueUpdateDraw(func() {
+				if pocket.locked.Load() {
+					return
+				}
+				PopMsg(pocket, nil, "failed to fetch notes, %v", err)
+			})
+			return
+		}
+		pocket.QueueUpdateDraw(func() {
+			if pocket.locked.Load() {
+				return
+			}
+			SetNotebookTree(pocket.ListPage.Notebooks, notebooks, pocket.ListPage.notebook)
+
+			pocket.ListPage.total.SetText(cast.ToString(total))
+
+			prev := pocket.ListPage.pageNum
+			if prev != page {
+				if page > prev && len(items) < 1 { // displyaing next page, but the page is empty
+					return
+				}
+
+				pocket.ListPage.pageNum = page
+				pocket.ListPage.page.SetText(cast.ToString(page))
+			}
+			pocket.ListPage.ClearNotes()
+			for _, it := range items {
+				pocket.ListPage.AddNote(it)
+			}
+
+			for _, th := range then {
+				th()
+			}
+		})
+	}()
+}
+
+func PopPasswordPage(pocket *Pocket) {
+	form := NewForm(false)
+
+	var tmppw string = ""
+	form.AddPasswordField("Password (8-32 english characters [0-9a-zA-Z-_!.]):", tmppw, 32, '*',
+		func(t string) { tmppw = t })
+
+	ni := form.GetFormItem(0).(*tview.InputField)
+	pocket.pwField = ni
+	resetPasswordField := func(msg string) {
+		ni.SetText("")
+		PopMsg(pocket, func() { pocket.SetFocus(ni) }, msg)
+	}
+
+	exists, err := pocket.Storage.VaultExists()
+	if err != nil {
+		Debugf("Failed to check whether vault exists, %v", err)
+	}
+
+	ni.SetInputCapture(func(e *tcell.EventKey) *tcell.EventKey {
+
+		if e.Key() == tcell.KeyEnter {
+			if err := ValidatePassword(tmppw); err != nil {
+				resetPasswordField(err.Error())
+				return nil
+			}
+			ok, err := pocket.Storage.CheckPassword(tmppw)
+			if err != nil {
+				resetPasswordField(err.Error())
+				return nil
+			}
+			if !ok {
+				resetPasswordField("password incorrect")
+				return nil
+			}
+			clearPasswordField(pocket) // don't keep the password in the field once unlocked
+
+			if err := pocket.Storage.InitSchema(); err != nil {
+				PopMsg(pocket, nil, err.Error())
+				return nil
+			}
+			uiUnlocked(pocket)
+
+			// new vault, recovery codes are only displayed once
+			if !exists {
+				codes, err := pocket.Storage.GenerateRecoveryCodes()
+				if err != nil {
+					PopMsg(pocket, nil, "Failed to generate recovery codes, %v", err)
+					return nil
+				}
+				PopRecoveryCodesPage(pocket, codes)
+			}
 			return nil
 		}
 
 		return e
 	})
 
+	height := 5
+	if exists {
+		form.AddButton("Forgot Password", func() { PopRecoverPage(pocket) })
+		height = 7
+	}
 	form.SetCancelFunc(pocket.Stop)
 	form.SetButtonsAlign(tview.AlignCenter)
-	form.SetBorder(true).SetTitle(" Enter Password ")
+	if _keyFile != "" {
+		form.SetBorder(true).SetTitle(" Enter Password (with key file) ")
+	} else {
+		form.SetBorder(true).SetTitle(" Enter Password ")
+	}
 
-	popup := createPopup(form, 5, 90)
+	popup := createPopup(form, height, 90)
 	pocket.Pages.AddPage(PagePassword, popup, true, true)
 }
 
+// Show the notes once the vault is unlocked.
+func uiUnlocked(pocket *Pocket) {
+	clearPasswordField(pocket)
+	pocket.locked.Store(false)
+	pocket.Touch()
+	pocket.RemovePage(PagePassword)
+	pocket.ToPage(PageList)
+	UIFetchNotes(pocket, 0)
+
+	go func() {
+		n, err := pocket.Storage.PurgeExpiredTrash()
+		if err == nil && n < 1 {
+			return
+		}
+		pocket.QueueUpdateDraw(func() {
+			if err != nil {
+				PopMsg(pocket, nil, "failed to purge trash, %v", err)
+				return
+			}
+			PopMsg(pocket, nil, "Purged %d notes that have been in trash for longer than the retention", n)
+		})
+	}()
+}
+
+// Clear the text of the password field, it also clears the password held by PopPasswordPage.
+func clearPasswordField(pocket *Pocket) {
+	if pocket.pwField != nil {
+		pocket.pwField.SetText("")
+	}
+}
+
+// Unlock the vault with recovery code, and set the new password.
+func PopRecoverPage(pocket *Pocket) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageRecover) }
+
+	var code, newPw, confirmPw string
+	form.AddInputField("Recovery Code:", "", 32, nil, func(t string) { code = t })
+	form.AddPasswordField("New Password:", "", 32, '*', func(t string) { newPw = t })
+	form.AddPasswordField("Confirm New Password:", "", 32, '*', func(t string) { confirmPw = t })
+
+	confirm := func() {
+		if err := ValidatePassword(newPw); err != nil {
+			PopMsg(pocket, nil, err.Error())
+			return
+		}
+		if newPw != confirmPw {
+			PopMsg(pocket, nil, "passwords do not match")
+			return
+		}
+		go func() {
+			left, err := pocket.Storage.RecoverPassword(code, newPw)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, err.Error())
+					return
+				}
+				close()
+				uiUnlocked(pocket)
+				PopMsg(pocket, nil, "Password reset, %v recovery codes left", left)
+			})
+		}()
+	}
+
+	form.AddButton("Reset Password", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Forgot Password ")
+
+	popup := createPopup(form, 11, 70)
+	pocket.Pages.AddPage(PageRecover, popup, true, true)
+}
+
+func PopRecoveryCodesPage(pocket *Pocket, codes []string) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageRecovery) }
+
+	msg := "Write down the recovery codes and keep them somewhere safe, each of them can be used once " +
+		"to reset the password if you forget it. They won't be displayed again.\n\n" + strings.Join(codes, "\n")
+	form.AddTextView("", msg, 60, len(codes)+4, false, false)
+	form.AddButton("Okay", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Recovery Codes ")
+
+	popup := createPopup(form, len(codes)+10, 66)
+	pocket.Pages.AddPage(PageRecovery, popup, true, true)
+	pocket.SetFocus(form.GetButton(0))
+}
+
+func PopRegenerateRecoveryPage(pocket *Pocket) {
+	PopConfirmDialog(pocket, func() {
+		pocket.RemovePage(PageConfirm)
+		go func() {
+			codes, err := pocket.Storage.GenerateRecoveryCodes()
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, err.Error())
+					return
+				}
+				PopRecoveryCodesPage(pocket, codes)
+			})
+		}()
+	}, "Generate new recovery codes?\nThe old ones will no longer work.", 50, 14)
+}
+
+func PopChangePasswordPage(pocket *Pocket) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageChangePw) }
+
+	var oldPw, newPw, confirmPw string
+	form.AddPasswordField("Current Password:", "", 32, '*', func(t string) { oldPw = t })
+	form.AddPasswordField("New Password:", "", 32, '*', func(t string) { newPw = t })
+	form.AddPasswordField("Confirm New Password:", "", 32, '*', func(t string) { confirmPw = t })
+
+	confirm := func() {
+		if err := ValidatePassword(newPw); err != nil {
+			PopMsg(pocket, nil, err.Error())
+			return
+		}
+		if newPw != confirmPw {
+			PopMsg(pocket, nil, "passwords do not match")
+			return
+		}
+		go func() {
+			err := pocket.Storage.ChangePassword(oldPw, newPw)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, err.Error())
+					return
+				}
+				close()
+				PopMsg(pocket, nil, "Password changed")
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Change Password ")
+
+	popup := createPopup(form, 11, 70)
+	pocket.Pages.AddPage(PageChangePw, popup, true, true)
+}
+
+func PopEncryptMetaPage(pocket *Pocket) {
+	enabled := !pocket.Storage.MetaEncrypted()
+	msg := "Encrypt name and description of all notes?\nSearching will be done in memory.\n\nWarning: tags and notebook paths are still stored in plaintext."
+	if !enabled {
+		msg = "Store name and description of all notes in plaintext?"
+	}
+	PopConfirmDialog(pocket, func() {
+		pocket.RemovePage(PageConfirm)
+		go func() {
+			err := pocket.Storage.SetMetaEncryption(enabled)
+			var baks []string
+			if err == nil && enabled {
+				baks, err = pocket.Storage.BackupFiles()
+			}
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, err.Error())
+					return
+				}
+				UIFetchNotes(pocket, 0)
+				if len(baks) > 0 {
+					PopMsg(pocket, nil, "%v backup files still contain plaintext names and descriptions, delete them if they are no longer needed, e.g., %v",
+						len(baks), baks[0])
+				}
+			})
+		}()
+	}, msg, 60, 16)
+}
+
+func PopMergePage(pocket *Pocket) {
+	form := NewForm(false)
+	close := func() { pocket.RemovePage(PageMerge) }
+
+	var file, pw string
+	form.AddInputField("Database File:", "", 60, nil, func(t string) { file = strings.TrimSpace(t) })
+	form.AddPasswordField("Password:", "", 32, '*', func(t string) { pw = t })
+
+	confirm := func() {
+		if file == "" {
+			PopMsg(pocket, nil, "database file is required")
+			return
+		}
+		if _, err := os.Stat(file); err != nil {
+			PopMsg(pocket, nil, "failed to open %v, %v", file, err)
+			return
+		}
+		go func() {
+			res, err := pocket.Storage.MergeDB(file, pw)
+			pocket.QueueUpdateDraw(func() {
+				if err != nil {
+					PopMsg(pocket, nil, err.Error())
+					return
+				}
+				close()
+				UIFetchNotes(pocket, 0)
+
+				msg := res.String()
+				for i, n := range res.Conflicts {
+					if i == 0 {
+						msg += "\n\nConflicts (not imported):"
+					}
+					if i > 4 {
+						msg += "\n..."
+						break
+					}
+					msg += fmt.Sprintf("\n%v (%v)", n.Name, n.Ctime.FormatClassic())
+				}
+				PopMsg(pocket, nil, "%s", msg)
+			})
+		}()
+	}
+
+	form.AddButton("Confirm", confirm)
+	form.AddButton("Close", close)
+	form.SetCancelFunc(close)
+	form.SetButtonsAlign(tview.AlignCenter)
+	form.SetBorder(true).SetTitle(" Merge Vault ")
+
+	popup := createPopup(form, 9, 80)
+	pocket.Pages.AddPage(PageMerge, popup, true, true)
+}
+
 func ValidatePassword(s string) error {
 	n := 0
 	for _, c := range s {
@@ -946,45 +2411,3 @@ func PopConfirmDialog(pocket *Pocket, confirm func(), msg string, width int, hei
 	pocket.Pages.AddPage(PageConfirm, popup, true, true)
 	pocket.SetFocus(form.GetButton(0))
 }
-
-func VimEdit(pocket *Pocket, content string, onClose func(s string)) {
-	pocket.Suspend(func() {
-		dir := os.TempDir()
-		os.MkdirAll(dir, 0755)
-
-		f, err := os.CreateTemp(dir, "pocket-*") // 0600
-		if err != nil {
-			PopMsg(pocket, nil, "Failed to create temp file, %v", err)
-			return
-		}
-		defer f.Close()
-		defer os.Remove(f.Name())
-
-		if _, err := f.WriteString(content); err != nil {
-			PopMsg(pocket, nil, "Failed to write to temp file, %v", err)
-			return
-		}
-		cmd := exec.Command("vim", f.Name())
-
-		// for term control
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-
-		if err := cmd.Run(); err != nil {
-			PopMsg(pocket, nil, "Failed to launch vim, %v", err)
-			return
-		}
-
-		out, err := os.ReadFile(f.Name())
-		if err != nil {
-			PopMsg(pocket, nil, "Failed to read from temp file, %v", err)
-			return
-		}
-
-		if out != nil {
-			onClose(string(out))
-		} else {
-			onClose("")
-		}
-	})
-}